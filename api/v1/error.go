@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -34,3 +35,440 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 	}
 	return std
 }
+
+// ErrOffsetCompacted is returned when reading an offset within the log's range
+// whose record has been removed by compaction, as a more recent record with the
+// same key superseded it.
+type ErrOffsetCompacted struct {
+	Offset uint64
+}
+
+func (e ErrOffsetCompacted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset compacted: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at the requested offset has been compacted away: %d",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrTopicNotFound is returned when a request refers to a topic that doesn't
+// exist.
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %q", e.Topic),
+	)
+	msg := fmt.Sprintf("The requested topic doesn't exist: %q", e.Topic)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrInvalidTopic is returned when creating a topic whose name isn't valid.
+// Topic names are made of letters, digits, dots, dashes and underscores, and
+// can't start with a dot.
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic name: %q", e.Topic),
+	)
+	msg := fmt.Sprintf(
+		"Topic names are made of up to 255 letters, digits, dots, dashes "+
+			"and underscores, and can't start with a dot: %q",
+		e.Topic,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrPartitionNotFound is returned when a request refers to a partition the
+// topic doesn't have.
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %q/%d", e.Topic, e.Partition),
+	)
+	msg := fmt.Sprintf(
+		"The requested partition doesn't exist in topic %q: %d",
+		e.Topic,
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrOutOfOrderSequence is returned when an idempotent producer sends a record
+// whose sequence number doesn't follow the previous one, or is a retry of a
+// record too old to be told apart from a new one.
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Sequence   uint64
+	Expected   uint64
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"out of order sequence for producer %d: %d, want %d",
+			e.ProducerID,
+			e.Sequence,
+			e.Expected,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The record's sequence number doesn't follow the producer's previous "+
+			"one, expected %d: %d",
+		e.Expected,
+		e.Sequence,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrTransactionNotFound is returned when appending to, committing or aborting
+// a transaction that isn't open in the log, e.g. because it has already ended.
+type ErrTransactionNotFound struct {
+	TransactionID uint64
+}
+
+func (e ErrTransactionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrTransactionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("transaction not found: %d", e.TransactionID),
+	)
+	msg := fmt.Sprintf(
+		"The transaction isn't open, it may have ended or timed out: %d",
+		e.TransactionID,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrRecordNotVisible is returned to read-committed consumers reading the
+// offset of a record they can't see, either because it is part of an aborted
+// transaction or because it is a control record.
+type ErrRecordNotVisible struct {
+	Offset uint64
+}
+
+func (e ErrRecordNotVisible) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrRecordNotVisible) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("record not visible: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record at the requested offset is part of an aborted transaction "+
+			"or is a control record: %d",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrNoCommittedOffset is returned when fetching the offset of a consumer group
+// which has never committed any for the given partition.
+type ErrNoCommittedOffset struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrNoCommittedOffset) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf(
+			"no committed offset for group %q: %q/%d",
+			e.Group,
+			e.Topic,
+			e.Partition,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The consumer group %q hasn't committed any offset for the partition: %q/%d",
+		e.Group,
+		e.Topic,
+		e.Partition,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrInvalidGroup is returned when a consumer group's name isn't valid, i.e. is
+// empty or contains a NUL character.
+type ErrInvalidGroup struct {
+	Group string
+}
+
+func (e ErrInvalidGroup) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrInvalidGroup) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid group name: %q", e.Group),
+	)
+	msg := fmt.Sprintf(
+		"Group names can't be empty nor contain NUL characters: %q",
+		e.Group,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrUnknownMember is returned when a consumer group doesn't have the given
+// member, e.g. because its session has timed out. The member has to join the
+// group again as a new member.
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown member of group %q: %q", e.Group, e.MemberID),
+	)
+	msg := fmt.Sprintf(
+		"The member isn't part of the consumer group %q anymore, it has to join it again: %q",
+		e.Group,
+		e.MemberID,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrStaleGeneration is returned when a member of a consumer group acts on
+// behalf of a generation of the group which has been superseded by a
+// rebalance. The member has to join the group again to get its new assignment.
+type ErrStaleGeneration struct {
+	Group      string
+	Generation uint64
+	Current    uint64
+}
+
+func (e ErrStaleGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrStaleGeneration) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"stale generation of group %q: %d, current is %d",
+			e.Group,
+			e.Generation,
+			e.Current,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The consumer group %q has been rebalanced since generation %d, the member has to join it again: current generation is %d",
+		e.Group,
+		e.Generation,
+		e.Current,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrLeaseNotFound is returned when acking or nacking a record which isn't
+// leased from the queue, e.g. because it has already been acked, or moved to
+// the dead-letter log.
+type ErrLeaseNotFound struct {
+	Offset uint64
+}
+
+func (e ErrLeaseNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrLeaseNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("record not leased: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The record isn't leased from the queue, it may have been acked already: %d",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrStaleLease is returned when acking or nacking a lease of a record which has
+// expired, and whose record has been leased again since, possibly to another
+// consumer. The lease is told apart by its number of deliveries.
+type ErrStaleLease struct {
+	Offset     uint64
+	Deliveries uint32
+	Current    uint32
+}
+
+func (e ErrStaleLease) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrStaleLease) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"stale lease of record %d: delivery %d, current is %d",
+			e.Offset,
+			e.Deliveries,
+			e.Current,
+		),
+	)
+	msg := fmt.Sprintf(
+		"The lease of record %d has expired and the record has been delivered again since delivery %d: current delivery is %d",
+		e.Offset,
+		e.Deliveries,
+		e.Current,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/soheilhy/cmux"
+	"github.com/tkhoa2711/proglog/internal/auth"
+	"github.com/tkhoa2711/proglog/internal/discovery"
+	"github.com/tkhoa2711/proglog/internal/log"
+	"github.com/tkhoa2711/proglog/internal/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type Config struct {
+	// ServerTLSConfig secures the connections accepted, both gRPC and Raft.
+	ServerTLSConfig *tls.Config
+	// PeerTLSConfig secures the Raft connections dialed to the other servers.
+	PeerTLSConfig *tls.Config
+	// DataDir is the directory the log is stored in.
+	DataDir string
+	// BindAddr is the host:port the server gossips on. The RPCs are served on
+	// the same host, on RPCPort.
+	BindAddr string
+	// RPCPort is the single port both gRPC and Raft are served on.
+	RPCPort int
+	// NodeName uniquely identifies the server within the cluster.
+	NodeName string
+	// StartJoinAddrs are the gossip addresses of members of the cluster to
+	// join on start.
+	StartJoinAddrs []string
+	ACLModelFile   string
+	ACLPolicyFile  string
+	// Bootstrap makes the server bootstrap a new cluster, see log.Config.
+	Bootstrap bool
+}
+
+// RPCAddr returns the address the RPCs are served on.
+func (c Config) RPCAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
+}
+
+// Agent runs a server of the cluster: its distributed log, the gRPC server in
+// front of it, and its membership of the cluster.
+//
+// gRPC and Raft share a single listener. The Raft connections start with the
+// log.RaftRPC byte, which tells them apart from the gRPC connections, both
+// secured with mTLS.
+type Agent struct {
+	Config
+
+	mux        cmux.CMux
+	log        *log.DistributedLog
+	server     *grpc.Server
+	membership *discovery.Membership
+
+	shutdown     bool
+	shutdownLock sync.Mutex
+}
+
+// New creates an agent and starts serving.
+func New(config Config) (*Agent, error) {
+	a := &Agent{
+		Config: config,
+	}
+	setup := []func() error{
+		a.setupMux,
+		a.setupLog,
+		a.setupServer,
+		a.setupMembership,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			a.Shutdown()
+			return nil, err
+		}
+	}
+	go a.serve()
+	return a, nil
+}
+
+// setupMux listens on the RPC address, for the connections to be split
+// between Raft and gRPC.
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = cmux.New(ln)
+	return nil
+}
+
+// setupLog sets up the distributed log, whose Raft connections are the ones
+// starting with the log.RaftRPC byte.
+func (a *Agent) setupLog() error {
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+	})
+
+	c := log.Config{}
+	c.Raft.StreamLayer = log.NewStreamLayer(
+		raftLn,
+		a.ServerTLSConfig,
+		a.PeerTLSConfig,
+	)
+	c.Raft.LocalID = raft.ServerID(a.NodeName)
+	c.Raft.Bootstrap = a.Bootstrap
+	var err error
+	a.log, err = log.NewDistributedLog(a.DataDir, c)
+	if err != nil {
+		return err
+	}
+	if a.Bootstrap {
+		return a.log.WaitForLeader(3 * time.Second)
+	}
+	return nil
+}
+
+// setupServer sets up the gRPC server in front of the distributed log, which
+// gets the remaining connections.
+func (a *Agent) setupServer() error {
+	serverConfig := &server.Config{
+		CommitLog:    a.log,
+		ServerGetter: a.log,
+		Authorizer:   auth.New(a.ACLModelFile, a.ACLPolicyFile),
+	}
+	var opts []grpc.ServerOption
+	if a.ServerTLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(a.ServerTLSConfig)))
+	}
+	var err error
+	a.server, err = server.NewGRPCServer(serverConfig, opts...)
+	if err != nil {
+		return err
+	}
+	grpcLn := a.mux.Match(cmux.Any())
+	go func() {
+		if err := a.server.Serve(grpcLn); err != nil {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// setupMembership joins the cluster, and makes the servers joining and leaving
+// it join and leave the Raft cluster.
+func (a *Agent) setupMembership() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	a.membership, err = discovery.New(a.log, discovery.Config{
+		NodeName:       a.NodeName,
+		BindAddr:       a.BindAddr,
+		RPCAddr:        rpcAddr,
+		StartJoinAddrs: a.StartJoinAddrs,
+	})
+	return err
+}
+
+// serve serves the connections of the listener until it is closed.
+func (a *Agent) serve() {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+	}
+}
+
+// Shutdown leaves the cluster, stops serving and closes the log. It only
+// shuts the agent down once, whatever the number of calls.
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+
+	var shutdown []func() error
+	if a.membership != nil {
+		shutdown = append(shutdown, a.membership.Leave, a.membership.Close)
+	}
+	if a.server != nil {
+		shutdown = append(shutdown, func() error {
+			a.server.GracefulStop()
+			return nil
+		})
+	}
+	if a.log != nil {
+		shutdown = append(shutdown, a.log.Close)
+	}
+	if a.mux != nil {
+		shutdown = append(shutdown, func() error {
+			a.mux.Close()
+			return nil
+		})
+	}
+	for _, fn := range shutdown {
+		if err := fn(); err != nil {
+			zap.L().Named("agent").Error("failed to shut down", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
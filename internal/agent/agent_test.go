@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"github.com/tkhoa2711/proglog/internal/config"
+	"github.com/tkhoa2711/proglog/internal/loadbalance"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestAgent(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := os.MkdirTemp("", "agent-test-log")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCPort:         ports[1],
+			DataDir:         dataDir,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Bootstrap:       i == 0,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+		}
+	}()
+
+	// Every server joins the Raft cluster through the membership
+	require.Eventually(t, func() bool {
+		servers, err := agents[0].log.GetServers()
+		return err == nil && len(servers) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Records are produced to the leader, through the port gRPC and Raft share
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	ctx := context.Background()
+	produceResponse, err := leaderClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+
+	// and replicated to the followers
+	followerClient := client(t, agents[1], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		consumeResponse, err := followerClient.Consume(ctx, &api.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		})
+		return err == nil && string(consumeResponse.Record.Value) == "foo"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// The load-balancing client finds the leader through a follower
+	lbClient := client(t, agents[2], peerTLSConfig)
+	for i := 0; i < 3; i++ {
+		_, err = lbClient.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("bar")},
+		})
+		require.NoError(t, err)
+	}
+	getServers, err := lbClient.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(getServers.Servers))
+	for _, srv := range getServers.Servers {
+		rpcAddr, err := agents[0].RPCAddr()
+		require.NoError(t, err)
+		require.Equal(t, srv.RpcAddr == rpcAddr, srv.IsLeader)
+	}
+}
+
+// client returns a client of the agent's servers, which dials the agent with
+// the proglog scheme so that requests are balanced across the cluster.
+func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
+	t.Helper()
+
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api.NewLogClient(conn)
+}
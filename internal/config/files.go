@@ -6,15 +6,17 @@ import (
 )
 
 var (
-	CAFile               = configFile("ca.pem")
-	ServerCertFile       = configFile("server.pem")
-	ServerKeyFile        = configFile("server-key.pem")
-	RootClientCertFile   = configFile("root-client.pem")
-	RootClientKeyFile    = configFile("root-client-key.pem")
-	NobodyClientCertFile = configFile("nobody-client.pem")
-	NobodyClientKeyFile  = configFile("nobody-client-key.pem")
-	ACLModelFile         = configFile("model.conf")
-	ACLPolicyFile        = configFile("policy.csv")
+	CAFile                   = configFile("ca.pem")
+	ServerCertFile           = configFile("server.pem")
+	ServerKeyFile            = configFile("server-key.pem")
+	RootClientCertFile       = configFile("root-client.pem")
+	RootClientKeyFile        = configFile("root-client-key.pem")
+	NobodyClientCertFile     = configFile("nobody-client.pem")
+	NobodyClientKeyFile      = configFile("nobody-client-key.pem")
+	ReplicatorClientCertFile = configFile("replicator-client.pem")
+	ReplicatorClientKeyFile  = configFile("replicator-client-key.pem")
+	ACLModelFile             = configFile("model.conf")
+	ACLPolicyFile            = configFile("policy.csv")
 )
 
 // configFile returns the full path of a given file
@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// rpcAddrTag is the tag each member advertises its RPC address with.
+const rpcAddrTag = "rpc_addr"
+
+type Config struct {
+	// NodeName uniquely identifies the server within the cluster.
+	NodeName string
+	// BindAddr is the host:port the server gossips on.
+	BindAddr string
+	// RPCAddr is the address the server's RPCs are served on, which is
+	// advertised to the other members.
+	RPCAddr string
+	// StartJoinAddrs are the gossip addresses of members of the cluster to
+	// join on start. A server starting a new cluster leaves it empty.
+	StartJoinAddrs []string
+}
+
+// Handler reacts to the servers joining and leaving the cluster, e.g. by
+// replicating them.
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+// Membership keeps track of the servers of the cluster, through gossip with
+// Serf, and tells the handler when they join, and when they leave or fail. The
+// local server isn't handled.
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	logger  *zap.Logger
+}
+
+// New makes the local server a member of the cluster, joining the given
+// members if any, and starts handling the others.
+func New(handler Handler, config Config) (*Membership, error) {
+	m := &Membership{
+		Config:  config,
+		handler: handler,
+		logger:  zap.L().Named("membership"),
+	}
+	if err := m.setupSerf(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// setupSerf starts gossiping on the bind address, with the RPC address as a
+// tag, and joins the cluster.
+func (m *Membership) setupSerf() error {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = map[string]string{
+		rpcAddrTag: m.RPCAddr,
+	}
+	config.NodeName = m.NodeName
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		if _, err = m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventHandler passes the membership changes on to the handler, until Serf
+// shuts down.
+func (m *Membership) eventHandler() {
+	for {
+		var e serf.Event
+		select {
+		case <-m.serf.ShutdownCh():
+			return
+		case e = <-m.events:
+		}
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags[rpcAddrTag],
+	); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+// isLocal reports whether the member is the local server.
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns the members of the cluster, as far as the local server knows,
+// the local server included.
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave leaves the cluster gracefully, so that the other members don't take the
+// local server for failed.
+func (m *Membership) Leave() error {
+	return m.serf.Leave()
+}
+
+// Close stops gossiping. Leave first to leave the cluster gracefully, the other
+// members take the local server for failed otherwise.
+func (m *Membership) Close() error {
+	return m.serf.Shutdown()
+}
+
+// logError logs the error the handler failed with. Only the Raft leader can
+// change the cluster's configuration, the other servers failing to do so is
+// expected, so it is only logged at the debug level.
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	log := m.logger.Error
+	if err == raft.ErrNotLeader {
+		log = m.logger.Debug
+	}
+	log(
+		msg,
+		zap.Error(err),
+		zap.String("name", member.Name),
+		zap.String(rpcAddrTag, member.Tags[rpcAddrTag]),
+	)
+}
@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"github.com/tkhoa2711/proglog/internal/log"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+// Both replication layers react to membership changes
+var (
+	_ Handler = (*log.Replicator)(nil)
+	_ Handler = (*log.DistributedLog)(nil)
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[2].Leave())
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			status(m[0], "2") == serf.StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.Equal(t, "2", <-handler.leaves)
+}
+
+// status returns the status of the member with the given name, as the given
+// member sees it.
+func status(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+// setupMember adds a member to the cluster of the given members, which it joins
+// through the first one. The handler of the first member records the joins and
+// leaves of the others.
+func setupMember(t *testing.T, members []*Membership) (
+	[]*Membership, *handler,
+) {
+	t.Helper()
+
+	id := len(members)
+	ports := dynaport.Get(2)
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:  fmt.Sprintf("127.0.0.1:%d", ports[1]),
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{members[0].BindAddr}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	members = append(members, m)
+	return members, h
+}
+
+// handler records the joins and leaves it is told about.
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
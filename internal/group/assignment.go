@@ -0,0 +1,106 @@
+package group
+
+import "sort"
+
+// assignRange assigns each topic separately, splitting its partitions into
+// contiguous ranges of about the same size, one for each member subscribed to
+// the topic in order of member ID. The first members get one more partition
+// when they can't be split evenly.
+func assignRange(
+	members map[string]*member,
+	partitions map[string]uint32,
+) map[string]Assignment {
+	assignments := newAssignments(members)
+	for _, topic := range subscribedTopics(members) {
+		subscribers := subscribersOf(members, topic)
+		n := partitions[topic]
+		size, extra := n/uint32(len(subscribers)), n%uint32(len(subscribers))
+
+		var next uint32
+		for i, id := range subscribers {
+			end := next + size
+			if uint32(i) < extra {
+				end++
+			}
+			for p := next; p < end; p++ {
+				assignments[id][topic] = append(assignments[id][topic], p)
+			}
+			next = end
+		}
+	}
+	return assignments
+}
+
+// assignRoundRobin deals the partitions of all topics, in order of topic and
+// partition, to the members in order of member ID, one at a time. A member
+// which isn't subscribed to a topic is skipped for its partitions.
+func assignRoundRobin(
+	members map[string]*member,
+	partitions map[string]uint32,
+) map[string]Assignment {
+	assignments := newAssignments(members)
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var next int
+	for _, topic := range subscribedTopics(members) {
+		for p := uint32(0); p < partitions[topic]; p++ {
+			// There is at least one subscriber to the topic
+			for !subscribes(members[ids[next%len(ids)]], topic) {
+				next++
+			}
+			id := ids[next%len(ids)]
+			assignments[id][topic] = append(assignments[id][topic], p)
+			next++
+		}
+	}
+	return assignments
+}
+
+// newAssignments returns an empty assignment for each member.
+func newAssignments(members map[string]*member) map[string]Assignment {
+	assignments := make(map[string]Assignment, len(members))
+	for id := range members {
+		assignments[id] = make(Assignment)
+	}
+	return assignments
+}
+
+// subscribedTopics returns the topics at least one member subscribes to, in
+// order.
+func subscribedTopics(members map[string]*member) []string {
+	seen := make(map[string]bool)
+	var topics []string
+	for _, m := range members {
+		for _, topic := range m.topics {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// subscribersOf returns the IDs of the members subscribed to the topic, in
+// order.
+func subscribersOf(members map[string]*member, topic string) []string {
+	var ids []string
+	for id, m := range members {
+		if subscribes(m, topic) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// subscribes reports whether the member subscribes to the topic.
+func subscribes(m *member, topic string) bool {
+	i := sort.SearchStrings(m.topics, topic)
+	return i < len(m.topics) && m.topics[i] == topic
+}
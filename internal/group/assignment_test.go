@@ -0,0 +1,36 @@
+package group
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssign(t *testing.T) {
+	members := map[string]*member{
+		"a": {topics: []string{"orders", "payments"}},
+		"b": {topics: []string{"orders", "payments"}},
+		"c": {topics: []string{"orders"}},
+	}
+	partitions := map[string]uint32{"orders": 5, "payments": 3}
+
+	require.Equal(t, map[string]Assignment{
+		"a": {"orders": {0, 1}, "payments": {0, 1}},
+		"b": {"orders": {2, 3}, "payments": {2}},
+		"c": {"orders": {4}},
+	}, assignRange(members, partitions))
+
+	require.Equal(t, map[string]Assignment{
+		"a": {"orders": {0, 3}, "payments": {0, 2}},
+		"b": {"orders": {1, 4}, "payments": {1}},
+		"c": {"orders": {2}},
+	}, assignRoundRobin(members, partitions))
+
+	// Members get nothing when there are more members than partitions
+	partitions["orders"] = 1
+	delete(members, "c")
+	require.Equal(t, map[string]Assignment{
+		"a": {"orders": {0}, "payments": {0, 1}},
+		"b": {"payments": {2}},
+	}, assignRange(members, partitions))
+}
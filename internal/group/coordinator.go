@@ -0,0 +1,318 @@
+package group
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// SessionTimeout is how long a member stays in its group without sending
+	// heartbeats before it is removed from it.
+	SessionTimeout time.Duration
+}
+
+// Assignment maps topics to the partitions assigned to a member.
+type Assignment map[string][]uint32
+
+// Member is a member of a consumer group as of a generation of the group.
+type Member struct {
+	ID         string
+	Generation uint64
+	Assignment Assignment
+}
+
+// Coordinator keeps track of the members of the consumer groups and assigns
+// them the partitions of the topics they subscribe to.
+//
+// Every time a member joins or leaves a group, or changes its subscriptions, the
+// group moves on to a new generation and the partitions are reassigned among
+// its members. The other members find out with their next heartbeat, which
+// fails with ErrStaleGeneration, and join the group again to get their new
+// assignment. Members acting on behalf of an older generation are fenced off,
+// so that they don't commit offsets for partitions which may have been
+// reassigned.
+type Coordinator struct {
+	Config
+
+	mu     sync.Mutex
+	groups map[string]*group
+
+	// done stops the session timeouts, wg waits for them to return
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// group is a consumer group. Groups without members are removed.
+type group struct {
+	generation uint64
+	strategy   api.AssignmentStrategy
+	// partitions is the number of partitions of the topics the members
+	// subscribe to, as of their last join
+	partitions map[string]uint32
+	members    map[string]*member
+}
+
+type member struct {
+	topics     []string
+	lastSeen   time.Time
+	assignment Assignment
+}
+
+// NewCoordinator creates a coordinator with the given config.
+func NewCoordinator(c Config) *Coordinator {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = 10 * time.Second
+	}
+	co := &Coordinator{
+		Config: c,
+		groups: make(map[string]*group),
+		done:   make(chan struct{}),
+	}
+	co.wg.Add(1)
+	go co.runSessionTimeouts()
+	return co
+}
+
+// Join adds a member to the group, subscribed to the given topics along with
+// their number of partitions, and returns its assignment. A new member passes
+// an empty member ID and gets one assigned. A member joining again with the
+// same subscriptions gets the assignment of the current generation, otherwise
+// the group is rebalanced. The strategy is only taken into account when the
+// group has no members yet.
+func (c *Coordinator) Join(
+	name, memberID string,
+	topics map[string]uint32,
+	strategy api.AssignmentStrategy,
+) (Member, error) {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return Member{}, api.ErrInvalidGroup{Group: name}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[name]
+	if !ok {
+		g = &group{
+			strategy:   strategy,
+			partitions: make(map[string]uint32),
+			members:    make(map[string]*member),
+		}
+	}
+
+	var m *member
+	changed := false
+	if memberID == "" {
+		id, err := newMemberID()
+		if err != nil {
+			return Member{}, err
+		}
+		memberID, m, changed = id, &member{}, true
+		g.members[memberID] = m
+	} else if m, ok = g.members[memberID]; !ok {
+		return Member{}, api.ErrUnknownMember{Group: name, MemberID: memberID}
+	}
+	c.groups[name] = g
+	m.lastSeen = time.Now()
+
+	subscriptions := make([]string, 0, len(topics))
+	for topic, n := range topics {
+		subscriptions = append(subscriptions, topic)
+		if g.partitions[topic] != n {
+			g.partitions[topic] = n
+			changed = true
+		}
+	}
+	sort.Strings(subscriptions)
+	if !equal(subscriptions, m.topics) {
+		m.topics = subscriptions
+		changed = true
+	}
+	if changed {
+		g.rebalance()
+	}
+
+	return Member{
+		ID:         memberID,
+		Generation: g.generation,
+		Assignment: m.assignment,
+	}, nil
+}
+
+// Heartbeat keeps the member in the group. It returns ErrStaleGeneration if
+// the group has been rebalanced since the given generation.
+func (c *Coordinator) Heartbeat(name, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, m, err := c.member(name, memberID)
+	if err != nil {
+		return err
+	}
+	m.lastSeen = time.Now()
+	if generation != g.generation {
+		return api.ErrStaleGeneration{
+			Group:      name,
+			Generation: generation,
+			Current:    g.generation,
+		}
+	}
+	return nil
+}
+
+// Leave removes the member from the group, whose partitions get reassigned to
+// the remaining members.
+func (c *Coordinator) Leave(name, memberID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, _, err := c.member(name, memberID); err != nil {
+		return err
+	}
+	c.remove(name, memberID)
+	return nil
+}
+
+// CheckGeneration returns an error unless the member may act on behalf of the
+// given generation of the group, e.g. commit offsets. Consumers which aren't
+// members, i.e. have an empty member ID, may only do so while the group has no
+// members.
+func (c *Coordinator) CheckGeneration(name, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if memberID == "" {
+		if g, ok := c.groups[name]; ok {
+			return api.ErrStaleGeneration{
+				Group:      name,
+				Generation: generation,
+				Current:    g.generation,
+			}
+		}
+		return nil
+	}
+
+	g, _, err := c.member(name, memberID)
+	if err != nil {
+		return err
+	}
+	if generation != g.generation {
+		return api.ErrStaleGeneration{
+			Group:      name,
+			Generation: generation,
+			Current:    g.generation,
+		}
+	}
+	return nil
+}
+
+// member returns the given member and its group, or ErrUnknownMember. It must
+// be called with the lock held.
+func (c *Coordinator) member(name, memberID string) (*group, *member, error) {
+	g, ok := c.groups[name]
+	if !ok {
+		return nil, nil, api.ErrUnknownMember{Group: name, MemberID: memberID}
+	}
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, nil, api.ErrUnknownMember{Group: name, MemberID: memberID}
+	}
+	return g, m, nil
+}
+
+// remove removes the member from the group and rebalances it, or removes the
+// group if it was its last member. It must be called with the lock held.
+func (c *Coordinator) remove(name, memberID string) {
+	g := c.groups[name]
+	delete(g.members, memberID)
+	if len(g.members) == 0 {
+		delete(c.groups, name)
+		return
+	}
+	g.rebalance()
+}
+
+// rebalance moves the group on to a new generation and reassigns the
+// partitions among its members.
+func (g *group) rebalance() {
+	g.generation++
+	var assignments map[string]Assignment
+	switch g.strategy {
+	case api.AssignmentStrategy_ROUND_ROBIN:
+		assignments = assignRoundRobin(g.members, g.partitions)
+	default:
+		assignments = assignRange(g.members, g.partitions)
+	}
+	for id, m := range g.members {
+		m.assignment = assignments[id]
+	}
+}
+
+// runSessionTimeouts periodically removes the members which haven't sent any
+// heartbeat within the session timeout, until the coordinator is closed.
+func (c *Coordinator) runSessionTimeouts() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			for name, g := range c.groups {
+				for id, m := range g.members {
+					if time.Since(m.lastSeen) <= c.SessionTimeout {
+						continue
+					}
+					c.remove(name, id)
+					zap.L().Named("group").Warn(
+						"removed member whose session timed out",
+						zap.String("group", name),
+						zap.String("member_id", id),
+					)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Close stops the session timeouts. Groups are kept in memory only, so they
+// are lost along with the coordinator.
+func (c *Coordinator) Close() error {
+	c.stopOnce.Do(func() { close(c.done) })
+	c.wg.Wait()
+	return nil
+}
+
+// newMemberID returns a random member ID.
+func newMemberID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// equal reports whether both slices hold the same strings in the same order.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
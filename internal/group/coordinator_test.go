@@ -0,0 +1,89 @@
+package group
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func TestCoordinator(t *testing.T) {
+	c := NewCoordinator(Config{})
+	defer c.Close()
+	topics := map[string]uint32{"orders": 4}
+
+	_, err := c.Join("", "", topics, api.AssignmentStrategy_RANGE)
+	require.Equal(t, api.ErrInvalidGroup{}, err)
+
+	a, err := c.Join("billing", "", topics, api.AssignmentStrategy_RANGE)
+	require.NoError(t, err)
+	require.NotEmpty(t, a.ID)
+	require.Equal(t, uint64(1), a.Generation)
+	require.Equal(t, Assignment{"orders": {0, 1, 2, 3}}, a.Assignment)
+	require.NoError(t, c.CheckGeneration("billing", a.ID, a.Generation))
+
+	// Consumers outside of the group can't commit while it has members
+	err = c.CheckGeneration("billing", "", 0)
+	require.Equal(t, api.ErrStaleGeneration{Group: "billing", Current: 1}, err)
+
+	// A new member rebalances the group, which fences off the first member
+	b, err := c.Join("billing", "", topics, api.AssignmentStrategy_RANGE)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), b.Generation)
+	err = c.Heartbeat("billing", a.ID, a.Generation)
+	require.Equal(t, api.ErrStaleGeneration{Group: "billing", Generation: 1, Current: 2}, err)
+	err = c.CheckGeneration("billing", a.ID, a.Generation)
+	require.Equal(t, api.ErrStaleGeneration{Group: "billing", Generation: 1, Current: 2}, err)
+
+	// Joining again with the same subscriptions doesn't rebalance the group
+	a, err = c.Join("billing", a.ID, topics, api.AssignmentStrategy_RANGE)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), a.Generation)
+	require.NoError(t, c.Heartbeat("billing", a.ID, a.Generation))
+	require.Len(t, a.Assignment["orders"], 2)
+	require.Len(t, b.Assignment["orders"], 2)
+	require.ElementsMatch(
+		t,
+		[]uint32{0, 1, 2, 3},
+		append(a.Assignment["orders"], b.Assignment["orders"]...),
+	)
+
+	// The remaining member gets all partitions back once the other one leaves
+	require.NoError(t, c.Leave("billing", b.ID))
+	err = c.Heartbeat("billing", b.ID, b.Generation)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: b.ID}, err)
+	a, err = c.Join("billing", a.ID, topics, api.AssignmentStrategy_RANGE)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), a.Generation)
+	require.Equal(t, Assignment{"orders": {0, 1, 2, 3}}, a.Assignment)
+
+	// The group is gone along with its last member
+	require.NoError(t, c.Leave("billing", a.ID))
+	require.NoError(t, c.CheckGeneration("billing", "", 0))
+}
+
+func TestCoordinatorSessionTimeout(t *testing.T) {
+	c := NewCoordinator(Config{SessionTimeout: 50 * time.Millisecond})
+	defer c.Close()
+	topics := map[string]uint32{"orders": 2}
+
+	a, err := c.Join("billing", "", topics, api.AssignmentStrategy_ROUND_ROBIN)
+	require.NoError(t, err)
+	b, err := c.Join("billing", "", topics, api.AssignmentStrategy_ROUND_ROBIN)
+	require.NoError(t, err)
+
+	// Only the first member keeps sending heartbeats, so the second one gets
+	// removed and its partition reassigned
+	require.Eventually(t, func() bool {
+		err := c.Heartbeat("billing", a.ID, b.Generation)
+		_, stale := err.(api.ErrStaleGeneration)
+		return stale
+	}, time.Second, 10*time.Millisecond)
+
+	err = c.Heartbeat("billing", b.ID, b.Generation)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: b.ID}, err)
+	a, err = c.Join("billing", a.ID, topics, api.AssignmentStrategy_ROUND_ROBIN)
+	require.NoError(t, err)
+	require.Equal(t, Assignment{"orders": {0, 1}}, a.Assignment)
+}
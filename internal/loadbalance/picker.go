@@ -0,0 +1,80 @@
+package loadbalance
+
+import (
+	"path"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}),
+	)
+}
+
+// consumeMethods are the methods which only read records, and can be served by
+// the followers.
+var consumeMethods = map[string]bool{
+	"Consume":       true,
+	"ConsumeStream": true,
+	"Fetch":         true,
+}
+
+// pickerBuilder builds a picker out of the servers connected to.
+type pickerBuilder struct{}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+// Build splits the servers connected to into the leader and the followers, as
+// told by the resolver.
+func (b *pickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderAttribute).(bool)
+		if isLeader {
+			p.leader = sc
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+// Picker routes the requests to the servers of the cluster. Records are
+// produced to the leader, which replicates them, and consumed from the
+// followers in a round-robin fashion, so that the leader doesn't serve every
+// request. The other requests go to the leader too, as the state they act on,
+// e.g. transactions and consumer groups, lives there.
+//
+// Records produced may take a moment to be replicated, so consumers may not get
+// to read them right away.
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+// Pick picks the server to send the request to. Consume requests fall back to
+// the leader while there is no follower to send them to.
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	if consumeMethods[path.Base(info.FullMethodName)] && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+// nextFollower returns the next follower in a round-robin fashion.
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, 1)
+	return p.followers[cur%uint64(len(p.followers))]
+}
@@ -0,0 +1,165 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the scheme of the targets the resolver resolves, e.g.
+// "proglog:///localhost:8400", and the name of the balancer it sets up.
+const Name = "proglog"
+
+// isLeaderAttribute is the attribute of the addresses which tells whether the
+// server is the leader.
+const isLeaderAttribute = "is_leader"
+
+const (
+	// resolveInterval is how often the servers are resolved again, so that
+	// the client finds out about the servers joining and leaving the cluster
+	resolveInterval = 10 * time.Second
+	// resolveTimeout is how long to wait for the servers to be listed
+	resolveTimeout = 5 * time.Second
+)
+
+func init() {
+	resolver.Register(&builder{})
+}
+
+// builder builds the resolvers of the proglog targets.
+type builder struct{}
+
+var _ resolver.Builder = (*builder)(nil)
+
+// Build dials the server of the target, with the credentials the client dials
+// with, and resolves the servers of its cluster through it.
+func (b *builder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(target.Endpoint, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Resolver{
+		clientConn:   cc,
+		resolverConn: conn,
+		serviceConfig: cc.ParseServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+		),
+		logger:  zap.L().Named("resolver"),
+		resolve: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	r.resolveServers()
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// Scheme returns the scheme of the targets the builder resolves.
+func (b *builder) Scheme() string {
+	return Name
+}
+
+// Resolver resolves the servers of a cluster with the GetServers RPC, and tells
+// which one is the leader in the attributes of their addresses, for the picker
+// to route the requests. The servers are resolved again periodically, and when
+// gRPC asks for it, e.g. after failing to connect to one of them.
+type Resolver struct {
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+
+	// resolve asks for the servers to be resolved again
+	resolve chan struct{}
+
+	// done stops the resolution, wg waits for it to return
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// ResolveNow asks for the servers to be resolved again.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolve <- struct{}{}:
+	default:
+		// A resolution is pending already
+	}
+}
+
+// run resolves the servers again periodically and when asked to, until the
+// resolver is closed.
+func (r *Resolver) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.resolve:
+		}
+		r.resolveServers()
+	}
+}
+
+// resolveServers lists the servers of the cluster and updates the client
+// connection with their addresses.
+func (r *Resolver) resolveServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	client := api.NewLogClient(r.resolverConn)
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderAttribute, server.IsLeader),
+		})
+	}
+	if err = r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update the resolved servers", zap.Error(err))
+	}
+}
+
+// Close stops resolving the servers.
+func (r *Resolver) Close() {
+	r.stopOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
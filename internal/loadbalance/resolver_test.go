@@ -0,0 +1,136 @@
+package loadbalance
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"github.com/tkhoa2711/proglog/internal/auth"
+	"github.com/tkhoa2711/proglog/internal/config"
+	"github.com/tkhoa2711/proglog/internal/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	getter := &getServers{servers: []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}}}
+	srv, err := server.NewGRPCServer(
+		&server.Config{
+			ServerGetter: getter,
+			Authorizer:   auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		},
+		grpc.Creds(credentials.NewTLS(serverTLSConfig)),
+	)
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+	conn := &clientConn{}
+	r, err := (&builder{}).Build(
+		resolver.Target{Endpoint: ln.Addr().String()},
+		conn,
+		resolver.BuildOptions{DialCreds: credentials.NewTLS(clientTLSConfig)},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	requireServers(t, conn, map[string]bool{"localhost:9001": true})
+
+	// The servers joining the cluster are resolved on demand
+	getter.set([]*api.Server{
+		{Id: "leader", RpcAddr: "localhost:9001", IsLeader: true},
+		{Id: "follower", RpcAddr: "localhost:9002"},
+	})
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Eventually(t, func() bool {
+		return len(conn.current().Addresses) == 2
+	}, time.Second, 10*time.Millisecond)
+	requireServers(t, conn, map[string]bool{
+		"localhost:9001": true,
+		"localhost:9002": false,
+	})
+}
+
+// requireServers checks the addresses the client connection was last updated
+// with, along with whether they are the leader's.
+func requireServers(t *testing.T, conn *clientConn, want map[string]bool) {
+	t.Helper()
+	got := make(map[string]bool)
+	for _, addr := range conn.current().Addresses {
+		got[addr.Addr] = addr.Attributes.Value(isLeaderAttribute).(bool)
+	}
+	require.Equal(t, want, got)
+}
+
+// getServers returns the servers it is set with.
+type getServers struct {
+	mu      sync.Mutex
+	servers []*api.Server
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers, nil
+}
+
+func (s *getServers) set(servers []*api.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+// clientConn records the state the resolver updates it with.
+type clientConn struct {
+	resolver.ClientConn
+
+	mu    sync.Mutex
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) current() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
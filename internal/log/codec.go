@@ -0,0 +1,112 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+var (
+	// The gzip and flate writers allocate large buffers, so they get reused
+	// across records
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+)
+
+// String returns the name of the codec.
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecFlate:
+		return "flate"
+	case CodecSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("Codec(%d)", uint8(c))
+}
+
+// valid reports whether the codec is a known one.
+func (c Codec) valid() bool {
+	return c <= CodecSnappy
+}
+
+// compress compresses b with the given codec. If that doesn't make it any
+// smaller, b is returned as is along with CodecNone, which is the codec that
+// must be stored with the returned data.
+func compress(c Codec, b []byte) ([]byte, Codec, error) {
+	var out []byte
+	switch c {
+	case CodecNone:
+		return b, CodecNone, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buf)
+		if err := writeAll(w, b); err != nil {
+			return nil, 0, err
+		}
+		out = buf.Bytes()
+	case CodecFlate:
+		var buf bytes.Buffer
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(&buf)
+		if err := writeAll(w, b); err != nil {
+			return nil, 0, err
+		}
+		out = buf.Bytes()
+	case CodecSnappy:
+		out = snappy.Encode(nil, b)
+	default:
+		return nil, 0, fmt.Errorf("unknown compression codec: %s", c)
+	}
+
+	if len(out) >= len(b) {
+		return b, CodecNone, nil
+	}
+	return out, c, nil
+}
+
+// writeAll writes b to w and closes it to flush the compressed data.
+func writeAll(w io.WriteCloser, b []byte) error {
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// decompress reverses compress for data stored with the given codec.
+func decompress(c Codec, b []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return b, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CodecFlate:
+		r := flate.NewReader(bytes.NewReader(b))
+		defer r.Close()
+		return io.ReadAll(r)
+	case CodecSnappy:
+		return snappy.Decode(nil, b)
+	}
+	return nil, fmt.Errorf("unknown compression codec: %s", c)
+}
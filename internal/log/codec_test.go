@@ -0,0 +1,131 @@
+package log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func TestCodec(t *testing.T) {
+	compressible := bytes.Repeat([]byte(`{"name":"proglog","level":"info"}`), 32)
+	random := make([]byte, 256)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecFlate, CodecSnappy} {
+		t.Run(codec.String(), func(t *testing.T) {
+			b, got, err := compress(codec, compressible)
+			require.NoError(t, err)
+			require.Equal(t, codec, got)
+			if codec != CodecNone {
+				require.Less(t, len(b), len(compressible))
+			}
+			b, err = decompress(got, b)
+			require.NoError(t, err)
+			require.Equal(t, compressible, b)
+
+			// Data that doesn't compress is stored as is
+			b, got, err = compress(codec, random)
+			require.NoError(t, err)
+			require.Equal(t, CodecNone, got)
+			require.Equal(t, random, b)
+		})
+	}
+
+	_, _, err = compress(Codec(42), compressible)
+	require.Error(t, err)
+	_, err = decompress(Codec(42), compressible)
+	require.Error(t, err)
+}
+
+func TestStoreCodec(t *testing.T) {
+	f, err := os.CreateTemp("", "store_codec_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(recordData, CodecSnappy)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	positions, discarded, err := s.Repair()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{pos}, positions)
+	require.Zero(t, discarded)
+
+	got, codec, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, recordData, got)
+	require.Equal(t, CodecSnappy, codec)
+}
+
+func TestLogMixedCodecs(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"proglog","level":"info"}`), 8)
+
+	dir, err := os.MkdirTemp("", "log-codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Change the codec every couple of records, reopening the log each time
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	var log *Log
+	for i, codec := range []Codec{CodecNone, CodecGzip, CodecFlate, CodecSnappy} {
+		c.Compression.Codec = codec
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		for j := 0; j < 2; j++ {
+			off, err := log.Append(&api.Record{Value: value})
+			require.NoError(t, err)
+			require.Equal(t, uint64(2*i+j), off)
+		}
+		if codec != CodecSnappy {
+			require.NoError(t, log.Close())
+		}
+	}
+	defer log.Close()
+
+	for off := uint64(0); off < 8; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, record.Value)
+		require.Equal(t, off, record.Offset)
+	}
+
+	// The first segment holds uncompressed records and a gzipped one
+	s := log.segments[0]
+	_, first, err := s.store.Read(formatWidth)
+	require.NoError(t, err)
+	require.Equal(t, CodecNone, first)
+	_, pos, err := s.index.Read(2)
+	require.NoError(t, err)
+	_, last, err := s.store.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, CodecGzip, last)
+
+	// A snapshot holds records compressed with different codecs too
+	restored := newTestLog(t, Config{})
+	defer os.RemoveAll(restored.Dir)
+	defer restored.Close()
+	reader := log.Reader()
+	defer reader.Close()
+	require.NoError(t, restored.Restore(reader))
+	for off := uint64(0); off < 8; off++ {
+		record, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, record.Value)
+	}
+
+	c.Compression.Codec = Codec(42)
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
@@ -0,0 +1,220 @@
+package log
+
+import (
+	"io"
+	"os"
+	"path"
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// compactDirPrefix prefixes the temporary directories compacted segments are
+// written to before replacing the original ones.
+const compactDirPrefix = ".compact-"
+
+// Compact rewrites the sealed segments so that they only keep the most recent
+// record for each key, along with the records without a key. Tombstones are
+// dropped as well once they are older than the tombstone retention. Records
+// keep their original offsets, so reading a compacted offset returns
+// ErrOffsetCompacted. The active segment is never compacted.
+//
+// Only the records read-committed consumers can see make the previous records
+// of their key obsolete: the records of aborted transactions, and the ones past
+// the first open transaction, which may yet be aborted, never do.
+func (l *Log) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.RLock()
+	segments := append([]*segment(nil), l.segments...)
+	l.mu.RUnlock()
+
+	// Records appended after the scan can only make more records obsolete, so
+	// the latest offsets are a safe, if conservative, view of the log
+	stable := l.stableOffset()
+	latest := make(map[string]uint64)
+	for _, s := range segments {
+		err := s.scan(func(record *api.Record) error {
+			if len(record.Key) == 0 || record.Offset >= stable {
+				return nil
+			}
+			if l.isAborted(record.TransactionId) {
+				return nil
+			}
+			latest[string(record.Key)] = record.Offset
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range segments[:len(segments)-1] {
+		if err := l.compactSegment(s, latest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// obsolete reports whether compaction can drop the given record, given the
+// latest offset of each key in the log, as far as read-committed consumers are
+// concerned.
+func (l *Log) obsolete(record *api.Record, latest map[string]uint64) bool {
+	if len(record.Key) == 0 {
+		return false
+	}
+	if off, ok := latest[string(record.Key)]; ok && off > record.Offset {
+		return true
+	}
+	age := time.Since(time.UnixMilli(record.Timestamp))
+	return len(record.Value) == 0 && age > l.Config.Compaction.TombstoneRetention
+}
+
+// compactSegment rewrites the given sealed segment without its obsolete
+// records. The records that are kept are written to a new segment in a
+// temporary directory, whose files then replace the original ones.
+func (l *Log) compactSegment(s *segment, latest map[string]uint64) error {
+	var kept []*api.Record
+	dropped := false
+	err := s.scan(func(record *api.Record) error {
+		if l.obsolete(record, latest) {
+			dropped = true
+		} else {
+			kept = append(kept, record)
+		}
+		return nil
+	})
+	if err != nil || !dropped {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(l.Dir, compactDirPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	compacted, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	for _, record := range kept {
+		compacted.nextOffset = record.Offset
+		if _, err = compacted.Append(record); err != nil {
+			compacted.Close()
+			return err
+		}
+	}
+	if err = compacted.Sync(); err != nil {
+		compacted.Close()
+		return err
+	}
+	if err = compacted.Close(); err != nil {
+		return err
+	}
+
+	if err = s.replace(compacted); err != nil {
+		return err
+	}
+	zap.L().Named("log").Debug(
+		"compacted segment",
+		zap.String("store", s.store.Name()),
+		zap.Int("kept_records", len(kept)),
+	)
+	return nil
+}
+
+// runCompaction periodically compacts the log until it is closed.
+func (l *Log) runCompaction() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.Config.Compaction.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := l.Compact(); err != nil {
+				zap.L().Named("log").Error(
+					"failed to compact the log",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// scan calls fn for each record of the segment, in order of offset. The read
+// lock is only held while reading each record so that appends to the active
+// segment aren't held up. A segment closed in the meantime has nothing left to
+// scan.
+func (s *segment) scan(fn func(record *api.Record) error) error {
+	for n := int64(0); ; n++ {
+		s.mu.RLock()
+		if s.closed {
+			s.mu.RUnlock()
+			return nil
+		}
+		_, pos, err := s.index.Read(n)
+		var record *api.Record
+		if err == nil {
+			record, err = s.readAt(pos)
+		}
+		s.mu.RUnlock()
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// replace swaps the files of the segment with the ones of the given closed
+// segment, which has the same base offset, and reopens them. Readers are held
+// off until the segment is reopened. Nothing is replaced if the segment has
+// been removed in the meantime.
+func (s *segment) replace(compacted *segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	dir := path.Dir(s.store.Name())
+	renames := [][2]string{
+		// The store goes first, any index left behind by a crash in between
+		// gets rebuilt from it when the segment is recovered
+		{compacted.store.Name(), s.store.Name()},
+		{compacted.index.Name(), s.index.Name()},
+		{compacted.timeIndex.Name(), s.timeIndex.Name()},
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+	for _, r := range renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			return err
+		}
+	}
+
+	reopened, err := newSegment(dir, s.baseOffset, s.config)
+	if err != nil {
+		return err
+	}
+	s.store = reopened.store
+	s.index = reopened.index
+	s.timeIndex = reopened.timeIndex
+	s.maxTimestamp = reopened.maxTimestamp
+	s.closed = false
+	return nil
+}
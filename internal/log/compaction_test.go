@@ -0,0 +1,249 @@
+package log
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+// appendKeyedRecords fills the log with records about a few keys, 3 records per
+// segment, and returns the offsets compaction is expected to keep.
+func appendKeyedRecords(t *testing.T, log *Log) (kept []uint64) {
+	t.Helper()
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Value: []byte("no key"), Headers: []*api.Header{
+			{Key: "source", Value: []byte("test")},
+		}},
+		{Key: []byte("a"), Value: []byte("a2")},
+		{Key: []byte("d")},                 // recent tombstone
+		{Key: []byte("c"), Timestamp: old}, // expired tombstone
+		{Key: []byte("b"), Value: []byte("b2")},
+		{Key: []byte("a"), Value: []byte("a3")},
+		{Key: []byte("b"), Value: []byte("b3")},
+		{Key: []byte("a"), Value: []byte("a4")},
+	}
+	offs, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Len(t, offs, len(records))
+	return []uint64{2, 4, 8, 9}
+}
+
+// requireCompacted checks that only the kept offsets can still be read from the
+// log, the other ones being reported as compacted.
+func requireCompacted(t *testing.T, log *Log, kept []uint64) {
+	t.Helper()
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+
+	isKept := make(map[uint64]bool)
+	for _, off := range kept {
+		isKept[off] = true
+	}
+	for off := uint64(0); off <= highest; off++ {
+		record, err := log.Read(off)
+		if !isKept[off] {
+			require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err, "offset %d", off)
+			continue
+		}
+		require.NoError(t, err, "offset %d", off)
+		require.Equal(t, off, record.Offset)
+	}
+
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("no key"), record.Value)
+	require.Equal(t, "source", record.Headers[0].Key)
+	require.Equal(t, []byte("test"), record.Headers[0].Value)
+
+	record, err = log.Read(8)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Key)
+	require.Equal(t, []byte("b3"), record.Value)
+
+	_, err = log.Read(highest + 1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: highest + 1}, err)
+}
+
+func newCompactedTestLog(t *testing.T) (*Log, []uint64) {
+	t.Helper()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	c.Compaction.TombstoneRetention = time.Hour
+	log := newTestLog(t, c)
+	t.Cleanup(func() { os.RemoveAll(log.Dir) })
+
+	kept := appendKeyedRecords(t, log)
+	require.NoError(t, log.Compact())
+	return log, kept
+}
+
+func TestLogCompact(t *testing.T) {
+	log, kept := newCompactedTestLog(t)
+	requireCompacted(t, log, kept)
+
+	// The active segment is left untouched
+	record, err := log.Read(9)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a4"), record.Value)
+
+	// Compacting again has nothing left to drop
+	require.NoError(t, log.Compact())
+	requireCompacted(t, log, kept)
+
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+func TestLogCompactReopen(t *testing.T) {
+	log, kept := newCompactedTestLog(t)
+	require.NoError(t, log.Close())
+
+	// The offsets left in the indexes have gaps, which recovery must keep
+	require.NoError(t, os.Remove(path.Join(log.Dir, "3.index")))
+	require.NoError(t, os.Remove(path.Join(log.Dir, "6.timeindex")))
+
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	requireCompacted(t, log, kept)
+
+	// The offsets of the trailing records compacted away from a segment
+	// still belong to it
+	require.Equal(t, uint64(6), log.segments[1].nextOffset)
+}
+
+func TestLogCompactRestore(t *testing.T) {
+	log, kept := newCompactedTestLog(t)
+	defer log.Close()
+
+	restored := newTestLog(t, log.Config)
+	defer os.RemoveAll(restored.Dir)
+	defer restored.Close()
+
+	reader := log.Reader()
+	defer reader.Close()
+	require.NoError(t, restored.Restore(reader))
+	for _, off := range kept {
+		record, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+
+	off, err := restored.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+}
+
+func TestLogCompactWhileReading(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	c.Compaction.TombstoneRetention = time.Hour
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+	defer log.Close()
+	appendKeyedRecords(t, log)
+	first := log.segments[0].store
+
+	// The reader is halfway through the first segment when the segments get
+	// compacted, and then removed by retention
+	reader := log.Reader()
+	_, _, err := readFrame(reader)
+	require.NoError(t, err)
+	require.NoError(t, log.Compact())
+	require.NoError(t, log.Truncate(9))
+
+	// The stream still holds every record as they were
+	for off := uint64(1); off < 10; off++ {
+		data, codec, err := readFrame(reader)
+		require.NoError(t, err, "offset %d", off)
+		record, err := unmarshalRecord(data, codec)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, _, err = readFrame(reader)
+	require.Equal(t, io.EOF, err)
+
+	// The files of the segments are closed along with the reader
+	_, err = first.File.Stat()
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	_, err = first.File.Stat()
+	require.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestLogCompactLeftovers(t *testing.T) {
+	log, _ := newCompactedTestLog(t)
+	require.NoError(t, log.Close())
+
+	leftover, err := os.MkdirTemp(log.Dir, compactDirPrefix)
+	require.NoError(t, err)
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = os.Stat(leftover)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLogCompactTransactions(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+	defer log.Close()
+
+	off, err := log.Append(&api.Record{Key: []byte("k"), Value: []byte("committed")})
+	require.NoError(t, err)
+
+	// The record of an aborted transaction isn't the latest one of its key
+	aborted, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{
+		Key:           []byte("k"),
+		Value:         []byte("aborted"),
+		TransactionId: aborted,
+	})
+	require.NoError(t, err)
+	require.NoError(t, log.AbortTransaction(aborted))
+
+	// Nor is the record of a transaction that is still open
+	open, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{
+		Key:           []byte("k"),
+		Value:         []byte("open"),
+		TransactionId: open,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("filler")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact())
+
+	record, err := log.ReadCommitted(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), record.Value)
+
+	// Once the open transaction commits, its record supersedes the committed one
+	require.NoError(t, log.CommitTransaction(open))
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("filler")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact())
+	_, err = log.ReadCommitted(off)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err)
+}
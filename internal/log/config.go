@@ -1,9 +1,128 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
 	Segment struct {
 		MaxIndexBytes uint64
 		MaxStoreBytes uint64
 		InitialOffset uint64
 	}
+	Retention struct {
+		// MaxBytes is the total size the log may grow to before its oldest
+		// segments get removed. Zero means no limit.
+		MaxBytes uint64
+		// MaxAge is how long a segment is kept after it was last written to.
+		// Zero means no limit.
+		MaxAge time.Duration
+		// CheckInterval is how often the retention policy is enforced.
+		CheckInterval time.Duration
+	}
+	Durability struct {
+		// Policy decides when appended records are synced to stable storage.
+		Policy SyncPolicy
+		// Interval is how often the log is synced with SyncInterval.
+		Interval time.Duration
+		// Bytes is how many bytes can be appended between two syncs with
+		// SyncBytes.
+		Bytes uint64
+	}
+	Compaction struct {
+		// Enabled turns on the periodic compaction of the sealed segments,
+		// which only keeps the most recent record for each key.
+		Enabled bool
+		// Interval is how often the log is compacted.
+		Interval time.Duration
+		// TombstoneRetention is how long a tombstone, i.e. a record with a key
+		// but no value, is kept after its timestamp so that consumers get to
+		// see the deletion before compaction drops it.
+		TombstoneRetention time.Duration
+	}
+	Producers struct {
+		// Expiry is how long the log remembers an idempotent producer after
+		// the timestamp of its last record, so that the state of producers
+		// which went away doesn't pile up. The next record of an expired
+		// producer is taken for the first one of a new producer. A negative
+		// expiry never expires them.
+		Expiry time.Duration
+	}
+	Transactions struct {
+		// Timeout is how long a transaction may stay open before it gets
+		// aborted, so that read-committed consumers don't wait forever for
+		// transactions whose producer went away. A negative timeout leaves
+		// it up to the caller to abort them, e.g. a DistributedLog aborts
+		// them through Raft so that every replica agrees.
+		Timeout time.Duration
+	}
+	Queue struct {
+		// VisibilityTimeout is how long a record leased from a queue stays
+		// hidden from the other consumers before being delivered again,
+		// unless it is acked in the meantime.
+		VisibilityTimeout time.Duration
+		// MaxDeliveries is how many times a record is delivered before it is
+		// moved to the dead-letter log.
+		MaxDeliveries uint32
+	}
+	Raft struct {
+		raft.Config
+		// StreamLayer carries the Raft traffic between the servers.
+		StreamLayer *StreamLayer
+		// Bootstrap makes the server bootstrap a new cluster with itself as
+		// its only voter, unless it has Raft state already. Exactly one server
+		// of a new cluster bootstraps it, the others join it.
+		Bootstrap bool
+	}
+	Compression struct {
+		// Codec is used to compress the records appended to the log. Records
+		// are stored along with the codec they were compressed with, so it can
+		// be changed without rewriting the log.
+		Codec Codec
+	}
+}
+
+// compacted returns the config of a log the package keeps internal state in,
+// which is compacted rather than subject to retention so that the latest record
+// of every key is always kept.
+func compacted(c Config) Config {
+	c.Compaction.Enabled = true
+	c.Retention.MaxBytes = 0
+	c.Retention.MaxAge = 0
+	return c
 }
+
+// SyncPolicy tells when the log commits its segments to stable storage, i.e.
+// how much acknowledged data may be lost on a crash of the machine.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves it up to the operating system to write the data to disk.
+	SyncNever SyncPolicy = iota
+	// SyncAlways syncs the log before acknowledging every append.
+	SyncAlways
+	// SyncInterval syncs the log periodically in the background.
+	SyncInterval
+	// SyncBytes syncs the log once enough bytes have been appended since the
+	// last sync.
+	SyncBytes
+)
+
+// Codec is a compression codec applied to the records in the store. Its value
+// is stored along with every record, so existing values must never change.
+type Codec uint8
+
+const (
+	// CodecNone stores records uncompressed.
+	CodecNone Codec = iota
+	// CodecGzip compresses records with gzip.
+	CodecGzip
+	// CodecFlate compresses records with raw DEFLATE, i.e. gzip without its
+	// header and footer.
+	CodecFlate
+	// CodecSnappy compresses records with Snappy, which is much faster than
+	// gzip and flate at the cost of a lower compression ratio.
+	CodecSnappy
+)
@@ -0,0 +1,854 @@
+package log
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// applyTimeout is how long to wait for a command to be committed and applied.
+const applyTimeout = 10 * time.Second
+
+// errNoStreamLayer is returned when the config lacks the Raft stream layer.
+var errNoStreamLayer = errors.New("raft stream layer not configured")
+
+// RequestType tells the FSM which command a Raft log entry holds. It is stored
+// in the first byte of the entry, so existing values must never change.
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = iota
+	AppendBatchRequestType
+	BeginTransactionRequestType
+	EndTransactionRequestType
+)
+
+// DistributedLog is a log replicated with Raft, for strong consistency.
+//
+// The records are appended by the leader through the Raft log, and only once
+// they are committed on a quorum of the servers, to the local log of each of
+// them, which is the replicated state machine. Reads are served from the local
+// log, so they may lag behind the leader on followers. The Raft log itself is
+// stored in a log too.
+//
+// Transactions go through Raft as well, so that every server agrees on their
+// IDs, and the leader aborts the ones which time out. The timestamps of the
+// records and control records are set by the leader when they are left empty,
+// so that they are the same on every server.
+type DistributedLog struct {
+	config Config
+	log    *Log
+	// raftLog is the log the Raft log is stored in
+	raftLog *logStore
+	stable  *stableStore
+	raft    *raft.Raft
+
+	// done stops the transaction timeouts, wg waits for them to return
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewDistributedLog creates a distributed log in the given directory, or opens
+// the existing one, and starts taking part in its Raft cluster.
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	if config.Raft.StreamLayer == nil {
+		return nil, errNoStreamLayer
+	}
+	if config.Transactions.Timeout == 0 {
+		config.Transactions.Timeout = time.Minute
+	}
+	l := &DistributedLog{
+		config: config,
+		done:   make(chan struct{}),
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		if l.raft != nil {
+			l.raft.Shutdown()
+		}
+		l.closeStores()
+		return nil, err
+	}
+	if config.Transactions.Timeout > 0 {
+		l.wg.Add(1)
+		go l.runTransactionTimeouts()
+	}
+	return l, nil
+}
+
+// setupLog creates the local log. Raft replays the entries committed since its
+// last snapshot on start, so the local log is rebuilt from scratch rather than
+// getting them appended twice.
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.RemoveAll(logDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	// Only the leader aborts transactions, through Raft
+	c := l.config
+	c.Transactions.Timeout = -1
+	var err error
+	l.log, err = NewLog(logDir, c)
+	return err
+}
+
+// setupRaft sets up the Raft log, stable and snapshot stores, the transport,
+// and starts Raft, bootstrapping a new cluster if required.
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	raftDir := filepath.Join(dataDir, "raft")
+	logDir := filepath.Join(raftDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	// Raft log indexes start at 1, and the entries are removed by Raft itself
+	// once they are part of a snapshot. Entries must be on disk before they are
+	// acknowledged to the leader, so that a committed entry survives a crash of
+	// the servers making up its quorum, whatever the local log's durability.
+	c := l.config
+	c.Durability.Policy = SyncAlways
+	c.Segment.InitialOffset = 1
+	c.Retention.MaxBytes = 0
+	c.Retention.MaxAge = 0
+	c.Compaction.Enabled = false
+	c.Transactions.Timeout = -1
+	raftLog, err := NewLog(logDir, c)
+	if err != nil {
+		return err
+	}
+	l.raftLog = &logStore{raftLog}
+
+	stableDir := filepath.Join(raftDir, "stable")
+	if err = os.MkdirAll(stableDir, 0755); err != nil {
+		return err
+	}
+	if l.stable, err = newStableStore(stableDir, l.config); err != nil {
+		return err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	transport := raft.NewNetworkTransport(
+		l.config.Raft.StreamLayer,
+		5,
+		10*time.Second,
+		os.Stderr,
+	)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+
+	hasState, err := raft.HasExistingState(l.raftLog, l.stable, snapshots)
+	if err != nil {
+		return err
+	}
+	l.raft, err = raft.NewRaft(
+		config,
+		&fsm{log: l.log},
+		l.raftLog,
+		l.stable,
+		snapshots,
+		transport,
+	)
+	if err != nil {
+		return err
+	}
+
+	if l.config.Raft.Bootstrap && !hasState {
+		err = l.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}).Error()
+	}
+	return err
+}
+
+// Append appends the record through the leader, and returns its offset once it
+// is committed. It returns raft.ErrNotLeader on followers.
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// AppendBatch appends the records through the leader, see Log.AppendBatch.
+func (l *DistributedLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	res, err := l.apply(
+		AppendBatchRequestType,
+		&api.ProduceBatchRequest{Records: records},
+	)
+	if err != nil {
+		return nil, err
+	}
+	batch := res.(*appendBatchResponse)
+	return batch.offsets, batch.err
+}
+
+// BeginTransaction opens a new transaction through the leader, see
+// Log.BeginTransaction.
+func (l *DistributedLog) BeginTransaction() (uint64, error) {
+	res, err := l.apply(
+		BeginTransactionRequestType,
+		&api.BeginTransactionRequest{},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.BeginTransactionResponse).TransactionId, nil
+}
+
+// CommitTransaction commits the given transaction through the leader.
+func (l *DistributedLog) CommitTransaction(id uint64) error {
+	_, err := l.apply(
+		EndTransactionRequestType,
+		&api.EndTransactionRequest{TransactionId: id, Commit: true},
+	)
+	return err
+}
+
+// AbortTransaction aborts the given transaction through the leader.
+func (l *DistributedLog) AbortTransaction(id uint64) error {
+	_, err := l.apply(
+		EndTransactionRequestType,
+		&api.EndTransactionRequest{TransactionId: id},
+	)
+	return err
+}
+
+// apply applies the command through Raft, and returns the FSM's response once
+// it is committed and applied on the local server.
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+	interface{}, error,
+) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(reqType))
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(b)
+
+	future := l.raft.Apply(buf.Bytes(), applyTimeout)
+	if err = future.Error(); err != nil {
+		return nil, err
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read reads the record at the given offset from the local log.
+func (l *DistributedLog) Read(off uint64) (*api.Record, error) {
+	return l.log.Read(off)
+}
+
+// ReadCommitted reads the record at the given offset from the local log on
+// behalf of a read-committed consumer.
+func (l *DistributedLog) ReadCommitted(off uint64) (*api.Record, error) {
+	return l.log.ReadCommitted(off)
+}
+
+// LowestOffset returns the offset of the first record in the local log.
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+// HighestOffset returns the offset of the last record in the local log.
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+// NextOffset returns the offset the next record will get in the local log.
+func (l *DistributedLog) NextOffset() (uint64, error) {
+	return l.log.NextOffset()
+}
+
+// Watch returns a channel that is closed once the local log holds a record at
+// the given offset.
+func (l *DistributedLog) Watch(off uint64) <-chan struct{} {
+	return l.log.Watch(off)
+}
+
+// WatchCommitted returns a channel that is closed once the record at the given
+// offset can be read from the local log by read-committed consumers.
+func (l *DistributedLog) WatchCommitted(off uint64) <-chan struct{} {
+	return l.log.WatchCommitted(off)
+}
+
+// OffsetForTimestamp looks up the offset for the given time in the local log.
+func (l *DistributedLog) OffsetForTimestamp(t time.Time) (uint64, error) {
+	return l.log.OffsetForTimestamp(t)
+}
+
+// Join adds the server with the given ID and Raft address to the cluster as a
+// voter. A server that is already part of the cluster with another ID or
+// address is replaced. It must be called on the leader.
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != serverID && srv.Address != serverAddr {
+			continue
+		}
+		if srv.ID == serverID && srv.Address == serverAddr {
+			// The server has already joined
+			return nil
+		}
+		if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+			return err
+		}
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server with the given ID from the cluster. It must be
+// called on the leader.
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// GetServers returns the servers of the cluster, with their Raft address and
+// whether they are the leader. Their Raft address is their RPC address too when
+// Raft shares their gRPC listener.
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leaderAddr, _ := l.raft.LeaderWithID()
+	var servers []*api.Server
+	for _, srv := range future.Configuration().Servers {
+		servers = append(servers, &api.Server{
+			Id:       string(srv.ID),
+			RpcAddr:  string(srv.Address),
+			IsLeader: srv.Address == leaderAddr,
+		})
+	}
+	return servers, nil
+}
+
+// WaitForLeader waits until the cluster has elected a leader, or returns an
+// error once the timeout elapses.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if addr, _ := l.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// runTransactionTimeouts periodically aborts the transactions that have been
+// open for longer than the transaction timeout while the server is the leader,
+// until the log is closed, see Log.runTransactionTimeouts.
+func (l *DistributedLog) runTransactionTimeouts() {
+	defer l.wg.Done()
+
+	timeout := l.config.Transactions.Timeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if l.raft.State() != raft.Leader {
+				continue
+			}
+			for _, id := range l.log.expiredTransactions(timeout) {
+				err := l.AbortTransaction(id)
+				if _, ended := err.(api.ErrTransactionNotFound); ended {
+					continue
+				}
+				if err != nil {
+					zap.L().Named("log").Error(
+						"failed to abort timed out transaction",
+						zap.String("dir", l.log.Dir),
+						zap.Uint64("transaction_id", id),
+						zap.Error(err),
+					)
+					continue
+				}
+				zap.L().Named("log").Warn(
+					"aborted timed out transaction",
+					zap.String("dir", l.log.Dir),
+					zap.Uint64("transaction_id", id),
+				)
+			}
+		}
+	}
+}
+
+// Close shuts Raft down and closes the logs.
+func (l *DistributedLog) Close() error {
+	l.stopOnce.Do(func() { close(l.done) })
+	l.wg.Wait()
+
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	return l.closeStores()
+}
+
+// closeStores closes the local log and the Raft log and stable stores which
+// have been set up.
+func (l *DistributedLog) closeStores() error {
+	var err error
+	if l.raftLog != nil {
+		err = l.raftLog.Close()
+	}
+	if l.stable != nil {
+		if serr := l.stable.Close(); err == nil {
+			err = serr
+		}
+	}
+	if l.log != nil {
+		if lerr := l.log.Close(); err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm applies the commands committed through Raft to the local log.
+type fsm struct {
+	log *Log
+}
+
+// appendBatchResponse is the response of the FSM to an AppendBatch command,
+// which may have appended some of the records before failing.
+type appendBatchResponse struct {
+	offsets []uint64
+	err     error
+}
+
+// Apply applies the committed command to the local log. The time the leader
+// appended the command at stands in for the empty timestamps, so that every
+// server stores the same records.
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	if len(record.Data) == 0 {
+		return fmt.Errorf("empty command at index %d", record.Index)
+	}
+	reqType := RequestType(record.Data[0])
+	b := record.Data[1:]
+	ts := record.AppendedAt.UnixMilli()
+
+	switch reqType {
+	case AppendRequestType:
+		var req api.ProduceRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		if req.Record.Timestamp == 0 {
+			req.Record.Timestamp = ts
+		}
+		off, err := f.log.Append(req.Record)
+		if err != nil {
+			return err
+		}
+		return &api.ProduceResponse{Offset: off}
+	case AppendBatchRequestType:
+		var req api.ProduceBatchRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		for _, r := range req.Records {
+			if r.Timestamp == 0 {
+				r.Timestamp = ts
+			}
+		}
+		offs, err := f.log.AppendBatch(req.Records)
+		return &appendBatchResponse{offsets: offs, err: err}
+	case BeginTransactionRequestType:
+		id, err := f.log.beginTransaction(ts)
+		if err != nil {
+			return err
+		}
+		return &api.BeginTransactionResponse{TransactionId: id}
+	case EndTransactionRequestType:
+		var req api.EndTransactionRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		control := api.ControlType_ABORT
+		if req.Commit {
+			control = api.ControlType_COMMIT
+		}
+		if err := f.log.endTransaction(req.TransactionId, control, ts); err != nil {
+			return err
+		}
+		return &api.EndTransactionResponse{}
+	default:
+		return fmt.Errorf("unknown request type %d at index %d", reqType, record.Index)
+	}
+}
+
+// Snapshot returns a snapshot of the records in the local log.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{reader: f.log.Reader()}, nil
+}
+
+// Restore replaces the local log with the records of the snapshot.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	return f.log.Restore(r)
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.ReadCloser
+}
+
+// Persist writes the snapshot to the sink.
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release lets go of the segments of the log the snapshot was taken from.
+func (s *snapshot) Release() {
+	_ = s.reader.Close()
+}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+const (
+	// Widths of the fields of a Raft log entry stored in a record, followed
+	// by its extensions and data
+	logTypeWidth       = 1
+	logTermWidth       = 8
+	logAppendedAtWidth = 8
+	logExtLenWidth     = 4
+	logHeaderWidth     = logTypeWidth + logTermWidth + logAppendedAtWidth + logExtLenWidth
+)
+
+// logStore stores the Raft log in a log, one entry per record at the offset of
+// its index.
+type logStore struct {
+	*Log
+}
+
+// FirstIndex returns the index of the first entry.
+func (s *logStore) FirstIndex() (uint64, error) {
+	return s.LowestOffset()
+}
+
+// LastIndex returns the index of the last entry, 0 if there is none.
+func (s *logStore) LastIndex() (uint64, error) {
+	return s.HighestOffset()
+}
+
+// GetLog reads the entry at the given index into out.
+func (s *logStore) GetLog(index uint64, out *raft.Log) error {
+	record, err := s.Read(index)
+	switch err.(type) {
+	case nil:
+	case api.ErrOffsetOutOfRange, api.ErrOffsetCompacted:
+		return raft.ErrLogNotFound
+	default:
+		return err
+	}
+
+	b := record.Value
+	if len(b) < logHeaderWidth {
+		return fmt.Errorf("invalid raft log entry at %d", index)
+	}
+	extLen := binary.BigEndian.Uint32(b[logTypeWidth+logTermWidth+logAppendedAtWidth:])
+	if uint64(len(b)) < logHeaderWidth+uint64(extLen) {
+		return fmt.Errorf("invalid raft log entry at %d", index)
+	}
+	out.Index = record.Offset
+	out.Type = raft.LogType(b[0])
+	out.Term = binary.BigEndian.Uint64(b[logTypeWidth:])
+	out.AppendedAt = time.Time{}
+	if appendedAt := int64(binary.BigEndian.Uint64(b[logTypeWidth+logTermWidth:])); appendedAt != 0 {
+		out.AppendedAt = time.Unix(0, appendedAt)
+	}
+	out.Extensions = nil
+	if extLen > 0 {
+		out.Extensions = b[logHeaderWidth : logHeaderWidth+extLen]
+	}
+	out.Data = b[logHeaderWidth+extLen:]
+	return nil
+}
+
+// StoreLog stores the entry at the offset of its index.
+func (s *logStore) StoreLog(record *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs stores the entries at the offsets of their indexes, and syncs them
+// all at once.
+func (s *logStore) StoreLogs(records []*raft.Log) error {
+	batch := make([]*api.Record, len(records))
+	for i, record := range records {
+		batch[i] = &api.Record{
+			Value:     encodeLogEntry(record),
+			Offset:    record.Index,
+			Timestamp: record.AppendedAt.UnixMilli(),
+		}
+	}
+	return s.appendBatchAt(batch)
+}
+
+// DeleteRange removes the entries with indexes between min and max, included.
+// Raft either removes the entries of a snapshot from the start of the log, or
+// the conflicting entries from its end.
+func (s *logStore) DeleteRange(min, max uint64) error {
+	last, err := s.LastIndex()
+	if err != nil {
+		return err
+	}
+	if max >= last {
+		return s.truncateFrom(min)
+	}
+	return s.Truncate(max + 1)
+}
+
+// encodeLogEntry encodes the Raft log entry into the value of a record.
+func encodeLogEntry(record *raft.Log) []byte {
+	b := make([]byte, logHeaderWidth, logHeaderWidth+len(record.Extensions)+len(record.Data))
+	b[0] = byte(record.Type)
+	binary.BigEndian.PutUint64(b[logTypeWidth:], record.Term)
+	var appendedAt int64
+	if !record.AppendedAt.IsZero() {
+		appendedAt = record.AppendedAt.UnixNano()
+	}
+	binary.BigEndian.PutUint64(b[logTypeWidth+logTermWidth:], uint64(appendedAt))
+	binary.BigEndian.PutUint32(
+		b[logTypeWidth+logTermWidth+logAppendedAtWidth:],
+		uint32(len(record.Extensions)),
+	)
+	b = append(b, record.Extensions...)
+	return append(b, record.Data...)
+}
+
+var _ raft.StableStore = (*stableStore)(nil)
+
+// errKeyNotFound is returned by the stable store for keys it doesn't hold, with
+// the message Raft expects.
+var errKeyNotFound = errors.New("not found")
+
+// stableStore stores Raft's current term and vote in a compacted log, with a
+// record per update. The latest values are also held in memory, where they are
+// read from.
+type stableStore struct {
+	log *Log
+
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+// newStableStore creates a stable store in the given directory, or opens the
+// existing one. Every update is synced, as Raft relies on votes not being
+// forgotten.
+func newStableStore(dir string, c Config) (*stableStore, error) {
+	c = compacted(c)
+	c.Durability.Policy = SyncAlways
+	c.Transactions.Timeout = -1
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &stableStore{
+		log:    l,
+		values: make(map[string][]byte),
+	}
+	err = l.scan(func(record *api.Record) error {
+		if len(record.Value) == 0 {
+			delete(s.values, string(record.Key))
+		} else {
+			s.values[string(record.Key)] = record.Value
+		}
+		return nil
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Set stores the value of the key.
+func (s *stableStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.log.Append(&api.Record{Key: key, Value: val}); err != nil {
+		return err
+	}
+	s.values[string(key)] = append([]byte(nil), val...)
+	return nil
+}
+
+// Get returns the value of the key, or an error if it isn't set.
+func (s *stableStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return val, nil
+}
+
+// SetUint64 stores the integer value of the key.
+func (s *stableStore) SetUint64(key []byte, val uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, val)
+	return s.Set(key, b)
+}
+
+// GetUint64 returns the integer value of the key, or an error if it isn't set.
+func (s *stableStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("invalid integer value of %q", key)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Close closes the log the values are stored in.
+func (s *stableStore) Close() error {
+	return s.log.Close()
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// RaftRPC is the byte the Raft connections start with, which tells them apart
+// from the other connections when they share a listener, e.g. with gRPC.
+const RaftRPC = 1
+
+// StreamLayer carries the Raft traffic between the servers over the given
+// listener, with TLS when configured. Every connection starts with the RaftRPC
+// byte, sent before the TLS handshake so that the listener can be shared.
+type StreamLayer struct {
+	ln net.Listener
+	// serverTLSConfig secures the connections accepted from the other servers
+	serverTLSConfig *tls.Config
+	// peerTLSConfig secures the connections dialed to the other servers
+	peerTLSConfig *tls.Config
+}
+
+// NewStreamLayer creates a stream layer over the given listener. Either TLS
+// config may be nil to go without TLS in that direction.
+func NewStreamLayer(
+	ln net.Listener,
+	serverTLSConfig, peerTLSConfig *tls.Config,
+) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+// Dial connects to the server at the given Raft address.
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (
+	net.Conn, error,
+) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+// Accept waits for the next connection from another server.
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if b[0] != RaftRPC {
+		conn.Close()
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		conn = tls.Server(conn, s.serverTLSConfig)
+	}
+	return conn, nil
+}
+
+// Close closes the listener.
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+// Addr returns the address of the listener.
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,134 @@
+package log_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"github.com/tkhoa2711/proglog/internal/log"
+	"github.com/tkhoa2711/proglog/internal/server"
+)
+
+var _ server.CommitLog = (*log.DistributedLog)(nil)
+
+func TestDistributedLog(t *testing.T) {
+	var logs []*log.DistributedLog
+	for i := 0; i < 3; i++ {
+		dir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		c := log.Config{}
+		c.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		c.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		c.Raft.ElectionTimeout = 50 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		c.Raft.Bootstrap = i == 0
+
+		l, err := log.NewDistributedLog(dir, c)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		}
+		logs = append(logs, l)
+	}
+	leader := logs[0]
+
+	// Records are appended through the leader and read from every server
+	want := map[uint64]string{}
+	for _, value := range []string{"a", "b"} {
+		off, err := leader.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+		want[off] = value
+	}
+	offs, err := leader.AppendBatch([]*api.Record{
+		{Value: []byte("c")},
+		{Value: []byte("d")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, offs)
+	want[2], want[3] = "c", "d"
+	for _, l := range logs {
+		requireDistributed(t, l, want)
+	}
+
+	// Every server stores the same timestamps, set by the leader
+	leaderRecord, err := leader.Read(0)
+	require.NoError(t, err)
+	require.NotZero(t, leaderRecord.Timestamp)
+	for _, l := range logs[1:] {
+		record, err := l.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, leaderRecord.Timestamp, record.Timestamp)
+	}
+
+	// Followers don't append
+	_, err = logs[1].Append(&api.Record{Value: []byte("x")})
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// Transactions are committed through the leader as well
+	id, err := leader.BeginTransaction()
+	require.NoError(t, err)
+	off, err := leader.Append(&api.Record{Value: []byte("e"), TransactionId: id})
+	require.NoError(t, err)
+	require.NoError(t, leader.CommitTransaction(id))
+	require.Equal(t, api.ErrTransactionNotFound{TransactionID: id}, leader.CommitTransaction(id))
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			record, err := l.ReadCommitted(off)
+			return err == nil && string(record.Value) == "e"
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+
+	servers, err := leader.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	for i, srv := range servers {
+		require.Equal(t, fmt.Sprintf("%d", i), srv.Id)
+		require.Equal(t, i == 0, srv.IsLeader)
+	}
+
+	// Servers which left stop getting the records
+	require.NoError(t, leader.Leave("1"))
+	servers, err = leader.GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+	require.Equal(t, "0", servers[0].Id)
+	require.Equal(t, "2", servers[1].Id)
+	time.Sleep(50 * time.Millisecond)
+	off, err = leader.Append(&api.Record{Value: []byte("f")})
+	require.NoError(t, err)
+	requireDistributed(t, logs[2], map[uint64]string{off: "f"})
+	time.Sleep(50 * time.Millisecond)
+	_, err = logs[1].Read(off)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+}
+
+// requireDistributed waits for the log to hold the given values at the given
+// offsets.
+func requireDistributed(t *testing.T, l *log.DistributedLog, want map[uint64]string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		for off, value := range want {
+			record, err := l.Read(off)
+			if err != nil || string(record.Value) != value {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 10*time.Millisecond)
+}
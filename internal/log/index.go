@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysontate/gommap"
 )
@@ -29,7 +30,14 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		return nil, err
 	}
 
+	// The size can't be trusted after an ungraceful shutdown, as the file may
+	// not have been trimmed back down on close. Here we only make sure that it
+	// stays within the memory-mapped region, the segment validates the entries.
 	idx.size = uint64(fi.Size())
+	if idx.size > c.Segment.MaxIndexBytes {
+		idx.size = c.Segment.MaxIndexBytes
+	}
+	idx.size -= idx.size % entryWidth
 
 	// Grow the file to the max index size before memory-mapping it
 	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
@@ -45,12 +53,17 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
-// Close flushes any pending changes and then closes the file.
-func (i *index) Close() error {
+// Sync commits the memory-mapped entries to stable storage.
+func (i *index) Sync() error {
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
-	if err := i.file.Sync(); err != nil {
+	return i.file.Sync()
+}
+
+// Close flushes any pending changes and then closes the file.
+func (i *index) Close() error {
+	if err := i.Sync(); err != nil {
 		return err
 	}
 	if err := i.file.Truncate(int64(i.size)); err != nil {
@@ -95,6 +108,31 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Reset drops all entries from the index.
+func (i *index) Reset() {
+	i.size = 0
+}
+
+// Find returns the position of the record at the given relative offset. The
+// n-th entry usually is the one for relative offset n, but compacted segments
+// have gaps in their offsets, in which case the entries are binary-searched.
+// It reports false if the index has no entry for the offset.
+func (i *index) Find(off uint32) (pos uint64, ok bool) {
+	if o, pos, err := i.Read(int64(off)); err == nil && o == off {
+		return pos, true
+	}
+	n := int(i.size / entryWidth)
+	j := sort.Search(n, func(j int) bool {
+		o, _, _ := i.Read(int64(j))
+		return o >= off
+	})
+	o, pos, err := i.Read(int64(j))
+	if err != nil || o != off {
+		return 0, false
+	}
+	return pos, true
+}
+
 // Name returns the name of the physical index file.
 func (i *index) Name() string {
 	return i.file.Name()
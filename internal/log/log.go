@@ -1,24 +1,81 @@
 package log
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
 )
 
+// restoreDirPrefix prefixes the temporary directories restored segments are
+// written to before replacing the log's segments.
+const restoreDirPrefix = ".restore-"
+
+var (
+	errLogClosed     = errors.New("log is closed")
+	errControlRecord = errors.New("control records can't be appended")
+)
+
+// Log is a sequence of segments, the last one being the active segment which
+// records get appended to.
+//
+// The log's lock only guards the list of segments and is held briefly when it
+// changes, i.e. when rolling over to a new segment or removing old segments.
+// Appends only lock the active segment, and reads only read-lock the segment
+// they read from, see ADR 005.
 type Log struct {
 	Dir    string
 	Config Config
 
 	segments      []*segment
 	activeSegment *segment
+	closed        bool
 
 	mu sync.RWMutex
+
+	// appended is closed and replaced every time records get appended, which
+	// wakes up everyone waiting for new records.
+	appended chan struct{}
+	notifyMu sync.Mutex
+
+	// unsynced is the number of bytes appended since the last sync. It is
+	// guarded by the active segment's lock.
+	unsynced uint64
+
+	// producers tracks the recent records of each idempotent producer to
+	// detect retries, and latestTimestamp the newest timestamp of the records
+	// appended, which idle producers expire against. They are guarded by the
+	// active segment's lock.
+	producers       map[uint64]*producerState
+	latestTimestamp int64
+
+	// lastTxnID is the ID of the last transaction that began. It is accessed
+	// atomically.
+	lastTxnID uint64
+	// openTxns and abortedTxns track the transactions, by ID, which are still
+	// open and which have been aborted along with the offset of their ABORT
+	// record. They are guarded by txnMu, and only changed with the active
+	// segment write-locked.
+	openTxns    map[uint64]transaction
+	abortedTxns map[uint64]uint64
+	txnMu       sync.RWMutex
+
+	// compactMu makes sure only one compaction runs at a time
+	compactMu sync.Mutex
+
+	// done stops the background tasks, wg waits for them to return
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 // NewLog creates a new log based on given config in the given directory.
@@ -29,11 +86,59 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Durability.Interval == 0 {
+		c.Durability.Interval = time.Second
+	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = time.Minute
+	}
+	if c.Compaction.TombstoneRetention == 0 {
+		c.Compaction.TombstoneRetention = 24 * time.Hour
+	}
+	if c.Producers.Expiry == 0 {
+		c.Producers.Expiry = 24 * time.Hour
+	}
+	if c.Transactions.Timeout == 0 {
+		c.Transactions.Timeout = time.Minute
+	}
+	if !c.Compression.Codec.valid() {
+		return nil, fmt.Errorf("unknown compression codec: %s", c.Compression.Codec)
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		done:   make(chan struct{}),
+
+		appended: make(chan struct{}),
+	}
+	if err := l.setup(); err != nil {
+		return nil, err
 	}
-	return l, l.setup()
+
+	if c.Retention.MaxBytes > 0 || c.Retention.MaxAge > 0 {
+		l.wg.Add(1)
+		go l.runRetention()
+	}
+	if c.Durability.Policy == SyncInterval {
+		l.wg.Add(1)
+		go l.runSync()
+	}
+	if c.Compaction.Enabled {
+		l.wg.Add(1)
+		go l.runCompaction()
+	}
+	if c.Producers.Expiry > 0 {
+		l.wg.Add(1)
+		go l.runProducerExpiry()
+	}
+	if c.Transactions.Timeout > 0 {
+		l.wg.Add(1)
+		go l.runTransactionTimeouts()
+	}
+	return l, nil
 }
 
 // setup initializes the log based on segments that already exists or, if this
@@ -44,11 +149,26 @@ func (l *Log) setup() error {
 		return err
 	}
 
+	// Files are stored with `offset.[store|index|timeindex]` format, so each
+	// base offset shows up once per file of the segment
+	seen := make(map[uint64]bool)
 	var baseOffsets []uint64
 	for _, file := range files {
-		// Files are stored with `offset.[store|index]` format
+		// Left behind by a compaction or a restore that didn't complete
+		if file.IsDir() && (strings.HasPrefix(file.Name(), compactDirPrefix) ||
+			strings.HasPrefix(file.Name(), restoreDirPrefix)) {
+			if err = os.RemoveAll(path.Join(l.Dir, file.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+
 		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil || seen[off] {
+			continue
+		}
+		seen[off] = true
 		baseOffsets = append(baseOffsets, off)
 	}
 
@@ -56,15 +176,10 @@ func (l *Log) setup() error {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	for _, off := range baseOffsets {
+		if err = l.newSegment(off); err != nil {
 			return err
 		}
-		// baseOffsets contains duplicates for index and store files, so we skip
-		// the dup here
-		// TODO: it's probably better to de-dup the slice separately but this
-		//   dead-simple approach works fine for now
-		i++
 	}
 
 	if l.segments == nil {
@@ -72,58 +187,813 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+
+	// The last records of a sealed segment may have been compacted away, but
+	// its range still extends up to the next segment
+	for i, s := range l.segments[:len(l.segments)-1] {
+		s.nextOffset = l.segments[i+1].baseOffset
+	}
+	return l.loadState()
+}
+
+// loadState rebuilds the state of the idempotent producers and of the
+// transactions from the records of the log. Transactions without a COMMIT or
+// ABORT record are still open, they can carry on or time out.
+func (l *Log) loadState() error {
+	l.producers = make(map[uint64]*producerState)
+	l.latestTimestamp = 0
+	l.resetTransactions()
+	for _, s := range l.segments {
+		err := s.scan(func(record *api.Record) error {
+			l.trackSequence(record, record.Offset)
+			l.trackTransaction(record, record.Offset)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn for every record of the log, in order of offset.
+func (l *Log) scan(fn func(record *api.Record) error) error {
+	l.mu.RLock()
+	segments := append([]*segment(nil), l.segments...)
+	l.mu.RUnlock()
+
+	for _, s := range segments {
+		if err := s.scan(fn); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// newSegment create a new segment for the log given the base offset
+// newSegment create a new segment for the log given the base offset. It is only
+// meant to be used while setting up the log, see rollSegment otherwise.
 func (l *Log) newSegment(baseOffset uint64) error {
 	s, err := newSegment(l.Dir, baseOffset, l.Config)
 	if err != nil {
 		return err
 	}
+	if l.activeSegment != nil {
+		l.activeSegment.sealed = true
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
 }
 
-// Append adds new record to the log and return its offset value.
-func (l *Log) Append(record *api.Record) (off uint64, err error) {
+// lockActiveSegment write-locks the active segment and returns it. The caller
+// is responsible for unlocking it.
+func (l *Log) lockActiveSegment() (*segment, error) {
+	for {
+		l.mu.RLock()
+		s, closed := l.activeSegment, l.closed
+		l.mu.RUnlock()
+		if closed {
+			return nil, errLogClosed
+		}
+
+		s.mu.Lock()
+		if !s.sealed {
+			return s, nil
+		}
+		// The segment has been rolled over in the meantime
+		s.mu.Unlock()
+	}
+}
+
+// rollSegment seals the given active segment, which must be write-locked by the
+// caller, and makes a new segment with the given base offset the active one.
+// The new segment is returned write-locked as well.
+func (l *Log) rollSegment(s *segment, baseOffset uint64) (*segment, error) {
+	next, err := newSegment(l.Dir, baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.sealSegment(s); err != nil {
+		next.Remove()
+		return nil, err
+	}
+
+	next.mu.Lock()
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.segments = append(l.segments, next)
+	l.activeSegment = next
+	l.mu.Unlock()
+	return next, nil
+}
+
+// sealSegment flushes the given segment, and unless the log is never synced,
+// syncs it as it won't be written to anymore. The segment must be write-locked
+// by the caller.
+func (l *Log) sealSegment(s *segment) error {
+	if l.Config.Durability.Policy == SyncNever {
+		if err := s.store.Flush(); err != nil {
+			return err
+		}
+	} else {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+		l.unsynced = 0
+	}
+	s.sealed = true
+	return nil
+}
+
+// Append adds new record to the log and return its offset value. It returns
+// once the record is as durable as required by the durability policy. A record
+// retried by an idempotent producer isn't appended again, the offset it was
+// appended at the first time is returned instead. A record that is part of a
+// transaction can only be appended while the transaction is open.
+func (l *Log) Append(record *api.Record) (off uint64, err error) {
+	if record.Control != api.ControlType_NONE {
+		return 0, errControlRecord
+	}
+	return l.append(record)
+}
+
+// append adds the given record, which may be a control record, to the log.
+func (l *Log) append(record *api.Record) (off uint64, err error) {
+	s, err := l.lockActiveSegment()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { s.mu.Unlock() }()
 
-	off, err = l.activeSegment.Append(record)
+	if off, duplicate, err := l.checkSequence(record); err != nil || duplicate {
+		return off, err
+	}
+	if err = l.checkTransaction(record); err != nil {
+		return 0, err
+	}
+
+	size := s.store.size
+	off, err = s.Append(record)
 	if err != nil {
 		return 0, err
 	}
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	if s, err = l.completeAppend(s, record, off, s.store.size-size); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// AppendAt adds a record replicated from another log at the offset it has
+// there, rather than at the next offset. Records at offsets the log already
+// has are ignored, so that replication can start over from the last record
+// replicated, and the offsets skipped, e.g. by compaction of the other log, are
+// left as gaps. The record isn't checked against the sequences of its producer
+// nor its transaction, the other log has done it already, but they are kept
+// track of.
+func (l *Log) AppendAt(record *api.Record) error {
+	s, err := l.lockActiveSegment()
+	if err != nil {
+		return err
+	}
+	defer func() { s.mu.Unlock() }()
+
+	if record.Offset < s.nextOffset {
+		return nil
+	}
+	size := s.store.size
+	off, err := s.AppendAt(record)
+	if err != nil {
+		return err
+	}
+	s, err = l.completeAppend(s, record, off, s.store.size-size)
+	return err
+}
+
+// appendBatchAt adds the given records replicated from another log at their
+// offsets there, see AppendAt, under a single lock acquisition. The buffered
+// data is flushed, or synced as required by the durability policy, once at the
+// end.
+func (l *Log) appendBatchAt(records []*api.Record) error {
+	s, err := l.lockActiveSegment()
+	if err != nil {
+		return err
+	}
+	defer func() { s.mu.Unlock() }()
+
+	appended := false
+	defer func() {
+		if appended {
+			l.notifyAppended()
+		}
+	}()
+
+	size := s.store.size
+	for _, record := range records {
+		if record.Offset < s.nextOffset {
+			continue
+		}
+		off, err := s.AppendAt(record)
+		if err != nil {
+			return err
+		}
+		appended = true
+		l.trackSequence(record, off)
+		l.trackTransaction(record, off)
+
+		if s.IsMaxed() {
+			next, err := l.rollSegment(s, off+1)
+			if err != nil {
+				return err
+			}
+			s.mu.Unlock()
+			s = next
+			size = s.store.size
+		}
+	}
+	if err = l.commit(s, s.store.size-size); err != nil {
+		return err
+	}
+	return s.store.Flush()
+}
+
+// completeAppend completes the append of the record at the given offset to the
+// given active segment, which n bytes have been appended to, and returns the
+// active segment, write-locked. It rolls the segment over once it is maxed.
+func (l *Log) completeAppend(s *segment, record *api.Record, off, n uint64) (*segment, error) {
+	l.trackSequence(record, off)
+	l.trackTransaction(record, off)
+	if err := l.commit(s, n); err != nil {
+		return s, err
+	}
+	l.notifyAppended()
+
+	if s.IsMaxed() {
+		next, err := l.rollSegment(s, off+1)
+		if err != nil {
+			return s, err
+		}
+		s.mu.Unlock()
+		s = next
+	}
+	return s, nil
+}
+
+// commit syncs the given active segment after n bytes have been appended to it,
+// if the durability policy requires so. The segment must be write-locked by the
+// caller.
+func (l *Log) commit(s *segment, n uint64) error {
+	d := l.Config.Durability
+	l.unsynced += n
+	if d.Policy == SyncAlways || (d.Policy == SyncBytes && l.unsynced >= d.Bytes) {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+		l.unsynced = 0
+	}
+	return nil
+}
+
+// runSync periodically syncs the active segment until the log is closed. The
+// sealed segments have already been synced when they were rolled over.
+func (l *Log) runSync() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.Config.Durability.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.RLock()
+			s := l.activeSegment
+			l.mu.RUnlock()
+
+			var err error
+			s.mu.RLock()
+			if !s.closed {
+				err = s.Sync()
+			}
+			s.mu.RUnlock()
+			if err != nil {
+				zap.L().Named("log").Error(
+					"failed to sync the log",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// AppendBatch adds the given records to the log under a single lock acquisition
+// and returns their offsets. Segments are rolled over in the middle of the batch
+// as needed, and the buffered data is flushed, or synced as required by the
+// durability policy, once at the end. If a record fails to be appended, the
+// offsets of the records appended before it are returned along with the error.
+// Records retried by an idempotent producer get the offsets they were appended
+// at the first time.
+func (l *Log) AppendBatch(records []*api.Record) (offs []uint64, err error) {
+	s, err := l.lockActiveSegment()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { s.mu.Unlock() }()
+
+	offs = make([]uint64, 0, len(records))
+	defer func() {
+		if len(offs) > 0 {
+			l.notifyAppended()
+		}
+	}()
+
+	size := s.store.size
+	for _, record := range records {
+		if record.Control != api.ControlType_NONE {
+			return offs, errControlRecord
+		}
+		off, duplicate, err := l.checkSequence(record)
+		if err != nil {
+			return offs, err
+		}
+		if duplicate {
+			offs = append(offs, off)
+			continue
+		}
+		if err = l.checkTransaction(record); err != nil {
+			return offs, err
+		}
+
+		off, err = s.Append(record)
+		if err != nil {
+			return offs, err
+		}
+		l.trackSequence(record, off)
+		offs = append(offs, off)
+
+		if s.IsMaxed() {
+			next, err := l.rollSegment(s, off+1)
+			if err != nil {
+				return offs, err
+			}
+			s.mu.Unlock()
+			s = next
+			size = 0
+		}
+	}
+	if err = l.commit(s, s.store.size-size); err != nil {
+		return offs, err
 	}
-	return off, err
+	return offs, s.store.Flush()
+}
+
+// Watch returns a channel that is closed once the log holds a record at the
+// given offset, so that readers can wait for new records without polling. The
+// returned channel is already closed if the record exists.
+func (l *Log) Watch(off uint64) <-chan struct{} {
+	// Get hold of the channel before checking the offset, so that it gets
+	// closed if the record is appended in between
+	l.notifyMu.Lock()
+	ch := l.appended
+	l.notifyMu.Unlock()
+
+	if off < l.nextOffset() {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return ch
+}
+
+// notifyAppended wakes up everyone watching for new records.
+func (l *Log) notifyAppended() {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// nextOffset returns the offset the next appended record will get.
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	s := l.activeSegment
+	l.mu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nextOffset
 }
 
 // Read reads the record stored at the given offset.
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	// Only the base offsets are used to look up the segment as they never
+	// change, the segment then checks the offset against its next offset
 	l.mu.RLock()
-	defer l.mu.RUnlock()
-
-	var s *segment
 	i := sort.Search(len(l.segments), func(i int) bool {
-		return off < l.segments[i].nextOffset
+		return off < l.segments[i].baseOffset
 	})
-	if i >= len(l.segments) {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	var s *segment
+	if i > 0 {
+		s = l.segments[i-1]
 	}
+	l.mu.RUnlock()
 
-	s = l.segments[i]
+	if s == nil {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
 	return s.Read(off)
 }
 
+// OffsetForTimestamp returns the offset of the first record whose timestamp is
+// at or after the given time. If there is no such record yet, it returns the
+// offset the next appended record will get.
+func (l *Log) OffsetForTimestamp(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	segments := append([]*segment(nil), l.segments...)
+	l.mu.RUnlock()
+
+	ts := t.UnixMilli()
+	for _, s := range segments {
+		if off, ok := s.OffsetForTimestamp(ts); ok {
+			return off, nil
+		}
+	}
+	return l.nextOffset(), nil
+}
+
+// LowestOffset returns the offset of the first record in the log.
+func (l *Log) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[0].baseOffset, nil
+}
+
+// NextOffset returns the offset the next appended record will get. The log
+// doesn't contain any record when it is equal to the lowest offset.
+func (l *Log) NextOffset() (uint64, error) {
+	return l.nextOffset(), nil
+}
+
+// HighestOffset returns the offset of the last record in the log. It returns 0
+// if the log doesn't contain any record yet, see NextOffset to tell both apart.
+func (l *Log) HighestOffset() (uint64, error) {
+	off := l.nextOffset()
+	if off == 0 {
+		return 0, nil
+	}
+	return off - 1, nil
+}
+
+// Truncate removes all segments whose records have offsets lower than the
+// given one. The active segment is never removed.
+func (l *Log) Truncate(lowest uint64) error {
+	return l.removeSegments(func(segments []*segment) (n int) {
+		for n < len(segments) && segments[n].nextOffset <= lowest {
+			n++
+		}
+		return n
+	})
+}
+
+// truncateFrom removes the records at the given offset and above, so that the
+// next record appended gets the given offset. The segments starting past the
+// offset are removed, and the one holding it becomes the active segment.
+//
+// The state of the idempotent producers and of the transactions isn't rolled
+// back along with the records, so it is only meant for logs without either,
+// like the Raft log whose conflicting entries get overwritten.
+func (l *Log) truncateFrom(off uint64) error {
+	// Keep compaction from replacing the segments in the meantime
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	active, err := l.lockActiveSegment()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	n := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset >= off
+	})
+	if n == 0 {
+		n = 1
+	}
+	removed := append([]*segment(nil), l.segments[n:]...)
+	last := l.segments[n-1]
+	l.segments = l.segments[:n]
+	l.activeSegment = last
+	l.mu.Unlock()
+
+	// Unless it is kept, the active segment is the last one to be removed
+	if last != active {
+		last.mu.Lock()
+		err = active.remove()
+		active.mu.Unlock()
+	}
+	defer last.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, s := range removed {
+		if s == active {
+			continue
+		}
+		if err = s.Remove(); err != nil {
+			return err
+		}
+	}
+
+	last.sealed = false
+	if err = last.truncate(off); err != nil {
+		return err
+	}
+	if last.IsMaxed() {
+		next, err := l.rollSegment(last, off)
+		if err != nil {
+			return err
+		}
+		next.mu.Unlock()
+	}
+	l.notifyAppended()
+	return nil
+}
+
+// EnforceRetention removes the oldest segments until the log fits within the
+// size and age limits of its retention policy. The active segment is never
+// removed.
+func (l *Log) EnforceRetention() error {
+	r := l.Config.Retention
+	return l.removeSegments(func(segments []*segment) (n int) {
+		total := l.activeSegment.Size()
+		for _, s := range segments {
+			total += s.Size()
+		}
+		for n < len(segments) {
+			s := segments[n]
+			tooBig := r.MaxBytes > 0 && total > r.MaxBytes
+			tooOld := r.MaxAge > 0 && time.Since(s.ModTime()) > r.MaxAge
+			if !tooBig && !tooOld {
+				break
+			}
+			total -= s.Size()
+			n++
+		}
+		return n
+	})
+}
+
+// runRetention periodically enforces the retention policy until the log is
+// closed.
+func (l *Log) runRetention() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.Config.Retention.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := l.EnforceRetention(); err != nil {
+				zap.L().Named("log").Error(
+					"failed to enforce retention",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// removeSegments takes the oldest segments out of the log and then deletes
+// their files. The pick function is given the sealed segments, from the oldest
+// to the newest, and returns how many of them to remove. The log is only
+// locked while the segments are taken out so that appends and reads aren't
+// held up by the file deletions.
+func (l *Log) removeSegments(pick func(segments []*segment) int) error {
+	l.mu.Lock()
+	n := pick(l.segments[:len(l.segments)-1])
+	removed := append([]*segment(nil), l.segments[:n]...)
+	l.segments = append([]*segment(nil), l.segments[n:]...)
+	lowest := l.segments[0].baseOffset
+	l.mu.Unlock()
+	l.forgetAbortedTransactions(lowest)
+
+	for _, s := range removed {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader returns a reader that streams the raw content of every segment's store
+// in order. It only covers the records present at the time of the call, so the
+// stream is a consistent prefix of the log even if new records keep coming in.
+//
+// The stores are pinned until the reader is closed, so that segments removed by
+// retention or rewritten by compaction in the meantime are still streamed as
+// they were. The reader must be closed once done with.
+func (l *Log) Reader() io.ReadCloser {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	r := &logReader{stores: make([]*store, len(l.segments))}
+	readers := make([]io.Reader, len(l.segments))
+	for i, s := range l.segments {
+		// Compaction swaps the store of the segment under its lock
+		s.mu.RLock()
+		pinned := s.store
+		pinned.pin()
+		s.mu.RUnlock()
+
+		r.stores[i] = pinned
+		size := int64(pinned.Size()) - formatWidth
+		readers[i] = io.NewSectionReader(pinned, formatWidth, size)
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r
+}
+
+// logReader streams the stores it pins, see Log.Reader.
+type logReader struct {
+	io.Reader
+	stores []*store
+}
+
+// Close releases the stores pinned by the reader.
+func (r *logReader) Close() error {
+	var err error
+	for _, s := range r.stores {
+		if e := s.unpin(); e != nil && err == nil {
+			err = e
+		}
+	}
+	r.stores = nil
+	return err
+}
+
+// Restore replaces the content of the log with the records read from r, which
+// is expected to be in the format produced by Reader. Segments and indexes are
+// rebuilt from scratch, and the records keep their original offsets.
+//
+// The segments are rebuilt in a temporary directory first, and only replace the
+// ones of the log once the whole stream has been read and checked. A truncated
+// or corrupt stream leaves the log as it was.
+func (l *Log) Restore(r io.Reader) (err error) {
+	dir, err := os.MkdirTemp(l.Dir, restoreDirPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err = l.restoreSegments(dir, r); err != nil {
+		return err
+	}
+
+	// Hold off appends and reads until the log has been rebuilt
+	active, err := l.lockActiveSegment()
+	if err != nil {
+		return err
+	}
+	defer active.mu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, s := range l.segments {
+		if s == active {
+			err = s.remove()
+		} else {
+			err = s.Remove()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	active.sealed = true
+	l.segments = nil
+	l.activeSegment = nil
+	l.unsynced = 0
+
+	// Whatever happens, the log is left with an active segment to append to
+	defer func() {
+		if l.activeSegment == nil {
+			if serr := l.newSegment(l.Config.Segment.InitialOffset); err == nil {
+				err = serr
+			}
+		}
+		l.notifyAppended()
+	}()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = os.Rename(path.Join(dir, file.Name()), path.Join(l.Dir, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	// The restored segments are opened just like when the log is opened, which
+	// rebuilds the state of the producers and of the transactions as well
+	return l.setup()
+}
+
+// restoreSegments writes the records read from r, see Restore, to new segments
+// in the given directory. The segments are synced unless the log is never
+// synced, and closed.
+func (l *Log) restoreSegments(dir string, r io.Reader) (err error) {
+	var s *segment
+	// seal syncs and closes the segment being written to
+	seal := func() error {
+		if l.Config.Durability.Policy != SyncNever {
+			if err := s.Sync(); err != nil {
+				s.Close()
+				return err
+			}
+		}
+		return s.Close()
+	}
+	defer func() {
+		if s == nil {
+			return
+		}
+		if serr := seal(); err == nil {
+			err = serr
+		}
+	}()
+
+	for {
+		b, codec, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Records get compressed again with this log's codec on append
+		record, err := unmarshalRecord(b, codec)
+		if err != nil {
+			return err
+		}
+
+		if s == nil {
+			if s, err = newSegment(dir, record.Offset, l.Config); err != nil {
+				return err
+			}
+		}
+		// Offsets may skip ahead where records have been compacted away
+		if record.Offset < s.nextOffset {
+			return fmt.Errorf(
+				"unexpected offset %d in the restored log, want at least %d",
+				record.Offset,
+				s.nextOffset,
+			)
+		}
+		s.nextOffset = record.Offset
+
+		off, err := s.Append(record)
+		if err != nil {
+			return err
+		}
+		if s.IsMaxed() {
+			err = seal()
+			s = nil
+			if err != nil {
+				return err
+			}
+			if s, err = newSegment(dir, off+1, l.Config); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 // Close closes the log and its segments.
 func (l *Log) Close() error {
+	l.stopOnce.Do(func() { close(l.done) })
+	l.wg.Wait()
+
+	active, err := l.lockActiveSegment()
+	if err == errLogClosed {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer active.mu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	for _, segment := range l.segments {
-		if err := segment.Close(); err != nil {
+
+	l.closed = true
+	active.sealed = true
+	for _, s := range l.segments {
+		if s == active {
+			err = s.close()
+		} else {
+			err = s.Close()
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -1,8 +1,12 @@
 package log
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	api "github.com/tkhoa2711/proglog/api/v1"
@@ -23,10 +27,21 @@ func TestLog(t *testing.T) {
 		"new log from existing state": testNewLogFromExistingState,
 		"append":                      testLogAppend,
 		"append over size limit":      testLogAppendOverSegmentSizeLimit,
+		"append batch":                testLogAppendBatch,
+		"append batch at":             testLogAppendBatchAt,
 		"read 1 segment w/ 1 record":  testLogReadOneSegmentWithOneRecord,
 		"read 1 segment full":         testLogReadOneSegmentFull,
 		"read 3 segments":             testLogReadThreeSegments,
 		"read out of range":           testLogReadOutOfRange,
+		"lowest/highest offset":       testLogLowestHighestOffset,
+		"offset for timestamp":        testLogOffsetForTimestamp,
+		"watch":                       testLogWatch,
+		"reader":                      testLogReader,
+		"restore":                     testLogRestore,
+		"restore corrupt stream":      testLogRestoreCorrupt,
+		"truncate":                    testLogTruncate,
+		"truncate active segment":     testLogTruncateActiveSegment,
+		"truncate from":               testLogTruncateFrom,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "log-test")
@@ -82,6 +97,58 @@ func testLogAppendOverSegmentSizeLimit(t *testing.T, log *Log) {
 	require.Equal(t, uint64(3), log.activeSegment.nextOffset)
 }
 
+func testLogAppendBatch(t *testing.T, log *Log) {
+	fillLogWithData(t, log, &api.Record{Value: []byte("first")}, 1)
+
+	var records []*api.Record
+	for i := 0; i < 6; i++ {
+		records = append(records, &api.Record{Value: []byte("Hello World!")})
+	}
+	watch := log.Watch(1)
+
+	offs, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, offs)
+	require.True(t, isClosed(watch))
+
+	// The batch spans over 3 segments
+	require.Equal(t, 3, len(log.segments))
+	require.Equal(t, uint64(6), log.activeSegment.baseOffset)
+
+	for off := uint64(1); off < 7; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[off-1].Value, got.Value)
+	}
+}
+
+func testLogAppendBatchAt(t *testing.T, log *Log) {
+	fillLogWithData(t, log, &api.Record{Value: []byte("first")}, 2)
+
+	// The records the log has already are skipped, the gaps are kept
+	var records []*api.Record
+	for _, off := range []uint64{1, 2, 3, 5, 6} {
+		records = append(records, &api.Record{Value: []byte("replicated"), Offset: off})
+	}
+	watch := log.Watch(2)
+	require.NoError(t, log.appendBatchAt(records))
+	require.True(t, isClosed(watch))
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), next)
+
+	got, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), got.Value)
+	for _, off := range []uint64{2, 3, 5, 6} {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("replicated"), got.Value)
+	}
+	_, err = log.Read(4)
+	require.Error(t, err)
+}
+
 func testLogReadOneSegmentWithOneRecord(t *testing.T, log *Log) {
 	record := &api.Record{
 		Value: []byte("Hello World!"),
@@ -132,3 +199,562 @@ func testLogReadOutOfRange(t *testing.T, log *Log) {
 	require.Equal(t, uint64(8), apiErr.Offset)
 	require.Nil(t, got)
 }
+
+func testLogLowestHighestOffset(t *testing.T, log *Log) {
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), next)
+
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 7)
+
+	next, err = log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), next)
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), highest)
+
+	err = log.Truncate(4)
+	require.NoError(t, err)
+
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+
+	highest, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), highest)
+}
+
+func testLogOffsetForTimestamp(t *testing.T, log *Log) {
+	start := time.Now()
+	for i := 0; i < 7; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		off, err := log.Append(&api.Record{
+			Value:     []byte("Hello World!"),
+			Timestamp: ts.UnixMilli(),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	for _, tt := range []struct {
+		t    time.Time
+		want uint64
+	}{
+		{start.Add(-time.Hour), 0},
+		{start, 0},
+		{start.Add(90 * time.Second), 2},
+		{start.Add(4 * time.Minute), 4},
+		{start.Add(6 * time.Minute), 6},
+		// Past the last record, consumers start from the tail
+		{start.Add(time.Hour), 7},
+	} {
+		off, err := log.OffsetForTimestamp(tt.t)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, off)
+	}
+
+	// Records without a timestamp are stamped on append
+	off, err := log.Append(&api.Record{Value: []byte("Hello World!")})
+	require.NoError(t, err)
+	got, err := log.Read(off)
+	require.NoError(t, err)
+	require.NotZero(t, got.Timestamp)
+}
+
+func testLogWatch(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 1)
+
+	// The record already exists
+	require.True(t, isClosed(log.Watch(0)))
+
+	watch := log.Watch(1)
+	require.False(t, isClosed(watch))
+	require.False(t, isClosed(log.Watch(2)))
+
+	_, err := log.Append(record)
+	require.NoError(t, err)
+	require.True(t, isClosed(watch))
+	require.False(t, isClosed(log.Watch(2)))
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func testLogReader(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 4)
+
+	reader := log.Reader()
+	defer reader.Close()
+
+	// Records appended afterward are not part of the stream
+	_, err := log.Append(record)
+	require.NoError(t, err)
+
+	b, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	r := bytes.NewReader(b)
+	for off := uint64(0); off < 4; off++ {
+		data, codec, err := readFrame(r)
+		require.NoError(t, err)
+
+		got, err := unmarshalRecord(data, codec)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+		require.Equal(t, off, got.Offset)
+	}
+	_, _, err = readFrame(r)
+	require.Equal(t, io.EOF, err)
+}
+
+func testLogRestore(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 7)
+	require.NoError(t, log.Truncate(3))
+
+	dir, err := os.MkdirTemp("", "log-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	restored, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer restored.Close()
+	fillLogWithData(t, restored, record, 1)
+
+	reader := log.Reader()
+	defer reader.Close()
+	err = restored.Restore(reader)
+	require.NoError(t, err)
+	require.Equal(t, len(log.segments), len(restored.segments))
+
+	lowest, err := restored.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+
+	for off := uint64(3); off < 7; off++ {
+		got, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+		require.Equal(t, off, got.Offset)
+	}
+
+	off, err := restored.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func testLogRestoreCorrupt(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 4)
+
+	dir, err := os.MkdirTemp("", "log-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restored, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer restored.Close()
+	fillLogWithData(t, restored, &api.Record{Value: []byte("live")}, 2)
+
+	reader := log.Reader()
+	defer reader.Close()
+	b, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	for _, r := range []io.Reader{
+		bytes.NewReader(b[:len(b)-1]),
+		bytes.NewReader(corrupt),
+	} {
+		require.Error(t, restored.Restore(r))
+
+		// The live log is left as it was
+		for off := uint64(0); off < 2; off++ {
+			got, err := restored.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte("live"), got.Value)
+		}
+		_, err = restored.Read(2)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		for _, file := range files {
+			require.False(t, file.IsDir(), file.Name())
+		}
+	}
+
+	off, err := restored.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testLogTruncate(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 7)
+	removed := log.segments[0]
+
+	// Offset 4 lives in the second segment, so only the first one goes away
+	err := log.Truncate(4)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, uint64(3), log.segments[0].baseOffset)
+
+	_, err = os.Stat(removed.store.Name())
+	require.True(t, os.IsNotExist(err))
+
+	_, err = log.Read(2)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+
+	for off := uint64(3); off < 7; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+}
+
+func testLogTruncateActiveSegment(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 4)
+
+	err := log.Truncate(100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(log.segments))
+	require.Equal(t, log.activeSegment, log.segments[0])
+
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func testLogTruncateFrom(t *testing.T, log *Log) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+	fillLogWithData(t, log, record, 7)
+
+	// Offset 4 lives in the second segment, the third one goes away
+	require.NoError(t, log.truncateFrom(4))
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, log.activeSegment, log.segments[1])
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+	_, err = log.Read(4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+
+	// The truncated offsets are appended to again
+	off, err := log.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	got, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), got.Value)
+	got, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, got.Value)
+
+	// Truncating from the start empties the log down to its first segment
+	require.NoError(t, log.truncateFrom(0))
+	require.Equal(t, 1, len(log.segments))
+	off, err = log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func TestLogRetention(t *testing.T) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+
+	for scenario, tt := range map[string]struct {
+		configure func(c *Config)
+		// number of segments left once the retention policy kicks in
+		segments int
+	}{
+		"max bytes": {
+			configure: func(c *Config) {
+				// Enough room for two full segments
+				c.Retention.MaxBytes = 2 * 3 * (headerWidth + 16)
+			},
+			segments: 2,
+		},
+		"max age": {
+			configure: func(c *Config) {
+				c.Retention.MaxAge = time.Nanosecond
+			},
+			segments: 1,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "log-retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+			c.Retention.CheckInterval = 10 * time.Millisecond
+			tt.configure(&c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fillLogWithData(t, log, record, 10)
+
+			require.Eventually(t, func() bool {
+				log.mu.RLock()
+				defer log.mu.RUnlock()
+				return len(log.segments) == tt.segments
+			}, time.Second, 10*time.Millisecond)
+
+			got, err := log.Read(9)
+			require.NoError(t, err)
+			require.Equal(t, uint64(9), got.Offset)
+		})
+	}
+}
+
+func TestLogDurability(t *testing.T) {
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+
+	// synced tells whether everything appended to the active segment has been
+	// written to its store file
+	synced := func(t *testing.T, log *Log) bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		fi, err := os.Stat(log.activeSegment.store.Name())
+		require.NoError(t, err)
+		return uint64(fi.Size()) == log.activeSegment.store.size
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T, c *Config) *Log{
+		"never": func(t *testing.T, c *Config) *Log {
+			c.Durability.Policy = SyncNever
+			log := newTestLog(t, *c)
+			fillLogWithData(t, log, record, 2)
+			require.False(t, synced(t, log))
+			return log
+		},
+		"always": func(t *testing.T, c *Config) *Log {
+			c.Durability.Policy = SyncAlways
+			log := newTestLog(t, *c)
+			fillLogWithData(t, log, record, 2)
+			require.True(t, synced(t, log))
+			return log
+		},
+		"interval": func(t *testing.T, c *Config) *Log {
+			c.Durability.Policy = SyncInterval
+			c.Durability.Interval = 10 * time.Millisecond
+			log := newTestLog(t, *c)
+			fillLogWithData(t, log, record, 2)
+			require.Eventually(t, func() bool {
+				return synced(t, log)
+			}, time.Second, 10*time.Millisecond)
+			return log
+		},
+		"bytes": func(t *testing.T, c *Config) *Log {
+			c.Durability.Policy = SyncBytes
+			c.Durability.Bytes = 40
+			log := newTestLog(t, *c)
+			fillLogWithData(t, log, record, 1)
+			require.False(t, synced(t, log))
+			_, err := log.Append(record)
+			require.NoError(t, err)
+			require.True(t, synced(t, log))
+			return log
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+			log := fn(t, &c)
+			defer os.RemoveAll(log.Dir)
+			require.NoError(t, log.Close())
+		})
+	}
+}
+
+func newTestLog(t *testing.T, c Config) *Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(t, err)
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	return log
+}
+
+func TestLogConcurrentAppendRead(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-concurrency-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 10
+	c.Retention.MaxBytes = 4096
+	c.Retention.CheckInterval = time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	record := &api.Record{
+		Value: []byte("Hello World!"),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := log.Append(&api.Record{Value: record.Value}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				highest, err := log.HighestOffset()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := log.Read(highest)
+				if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+					// Nothing appended yet, or removed by the retention
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(record.Value, got.Value) {
+					t.Errorf("got value %q, want %q", got.Value, record.Value)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(399), highest)
+}
+
+// BenchmarkLogReadWhileAppending measures how fast records from sealed segments
+// can be read while other records keep being appended. The "log lock" case
+// guards the log with a single lock, as it was before locking moved down to the
+// segments.
+func BenchmarkLogReadWhileAppending(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		logLock bool
+	}{
+		{"log lock", true},
+		{"segment locks", false},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "log-benchmark")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MaxIndexBytes = entryWidth * 100
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+
+			record := &api.Record{
+				Value: []byte("Hello World!"),
+			}
+			var mu sync.RWMutex
+			for i := 0; i < 1000; i++ {
+				_, err = log.Append(record)
+				require.NoError(b, err)
+			}
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if bm.logLock {
+						mu.Lock()
+					}
+					_, err := log.Append(&api.Record{Value: record.Value})
+					if bm.logLock {
+						mu.Unlock()
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var off uint64
+				for pb.Next() {
+					if bm.logLock {
+						mu.RLock()
+					}
+					_, err := log.Read(off % 1000)
+					if bm.logLock {
+						mu.RUnlock()
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					off++
+				}
+			})
+			b.StopTimer()
+
+			close(done)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package log
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+// topicNamePattern restricts topic names to what is safe to use as a directory
+// name.
+var topicNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]{0,254}$`)
+
+// LogManager owns the topics stored in its directory, each of them in the
+// Dir/<topic> directory. The logs of their partitions are created with the
+// manager's config.
+type LogManager struct {
+	Dir    string
+	Config Config
+
+	mu     sync.RWMutex
+	topics map[string]*Topic
+	closed bool
+}
+
+// NewLogManager creates a manager for the topics in the given directory, and
+// opens the logs of the topics that already exist.
+func NewLogManager(dir string, c Config) (*LogManager, error) {
+	m := &LogManager{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string]*Topic),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !topicNamePattern.MatchString(file.Name()) {
+			continue
+		}
+		t, err := newTopic(file.Name(), path.Join(dir, file.Name()), 0, c)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.topics[file.Name()] = t
+	}
+	return m, nil
+}
+
+// Topic returns the given topic, or ErrTopicNotFound if there is no such topic.
+func (m *LogManager) Topic(name string) (*Topic, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.topics[name]
+	if !ok || m.closed {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	return t, nil
+}
+
+// CreateTopic creates the given topic with the given number of partitions, 1
+// if zero, and returns it. If the topic already exists, it is returned as is,
+// with the number of partitions it was created with.
+func (m *LogManager) CreateTopic(name string, partitions uint32) (*Topic, error) {
+	if !topicNamePattern.MatchString(name) {
+		return nil, api.ErrInvalidTopic{Topic: name}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errLogClosed
+	}
+	if t, ok := m.topics[name]; ok {
+		return t, nil
+	}
+
+	dir := path.Join(m.Dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t, err := newTopic(name, dir, partitions, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	m.topics[name] = t
+	return t, nil
+}
+
+// Topics returns the names of all topics, sorted alphabetically.
+func (m *LogManager) Topics() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.topics))
+	for name := range m.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes the logs of all topics.
+func (m *LogManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for _, t := range m.topics {
+		if err := t.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
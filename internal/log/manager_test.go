@@ -0,0 +1,126 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func TestLogManager(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = m.Topic("orders")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+
+	orders, err := m.CreateTopic("orders", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), orders.Partitions())
+	for i := uint32(0); i < 3; i++ {
+		l, err := orders.Partition(i)
+		require.NoError(t, err)
+		require.Equal(t, path.Join(dir, "orders", fmt.Sprint(i)), l.Dir)
+	}
+	_, err = orders.Partition(3)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 3}, err)
+
+	// Creating an existing topic returns it as is
+	again, err := m.CreateTopic("orders", 5)
+	require.NoError(t, err)
+	require.Same(t, orders, again)
+
+	payments, err := m.CreateTopic("payments", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), payments.Partitions())
+	require.Equal(t, []string{"orders", "payments"}, m.Topics())
+
+	// Partitions have their own offsets
+	for _, n := range []uint32{0, 2, 2} {
+		l, err := orders.Partition(n)
+		require.NoError(t, err)
+		_, err = l.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	l, err := orders.Partition(2)
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	for _, name := range []string{"", ".", "..", ".hidden", "a/b", "a b"} {
+		_, err = m.CreateTopic(name, 1)
+		require.Equal(t, api.ErrInvalidTopic{Topic: name}, err)
+	}
+
+	// Existing topics are opened again with their partitions, anything else
+	// in the directory is left alone
+	require.NoError(t, os.Mkdir(path.Join(dir, ".compact-1"), 0755))
+	require.NoError(t, m.Close())
+	m, err = NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, []string{"orders", "payments"}, m.Topics())
+
+	orders, err = m.Topic("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), orders.Partitions())
+	l, err = orders.Partition(2)
+	require.NoError(t, err)
+	off, err = l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestLogManagerMissingPartition(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	_, err = m.CreateTopic("orders", 3)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	require.NoError(t, os.RemoveAll(path.Join(dir, "orders", "1")))
+	_, err = NewLogManager(dir, Config{})
+	require.Error(t, err)
+}
+
+func TestTopicPartitionFor(t *testing.T) {
+	dir, err := os.MkdirTemp("", "topic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topic, err := newTopic("orders", dir, 4, Config{})
+	require.NoError(t, err)
+	defer topic.Close()
+
+	// Records with the same key always go to the same partition
+	seen := make(map[uint32]bool)
+	for i := 0; i < 32; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		n := topic.PartitionFor(&api.Record{Key: key})
+		require.Less(t, n, uint32(4))
+		require.Equal(t, n, topic.PartitionFor(&api.Record{Key: key}))
+		seen[n] = true
+	}
+	require.Len(t, seen, 4)
+
+	// The hash is stable across versions, as records of a key must keep
+	// going to the partition they've always gone to
+	require.Equal(t, uint32(0x6815c86c%4), topic.PartitionFor(&api.Record{Key: []byte("key")}))
+
+	// Records without a key are spread over all partitions
+	for i := uint32(0); i < 8; i++ {
+		require.Equal(t, i%4, topic.PartitionFor(&api.Record{}))
+	}
+}
@@ -0,0 +1,104 @@
+package log
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+// OffsetStore keeps track of the offsets committed by consumer groups, i.e.
+// where each group is at in each partition it consumes. The offsets are stored
+// in a log, with a record per commit keyed by group, topic and partition, which
+// is compacted so that only the latest commit of each key is kept. The latest
+// offsets are also held in memory, where they are read from.
+type OffsetStore struct {
+	log *Log
+
+	mu      sync.RWMutex
+	offsets map[string]uint64
+}
+
+// NewOffsetStore creates an offset store in the given directory, or opens the
+// existing one. The log is always compacted, whatever the given config says.
+func NewOffsetStore(dir string, c Config) (*OffsetStore, error) {
+	l, err := NewLog(dir, compacted(c))
+	if err != nil {
+		return nil, err
+	}
+	s := &OffsetStore{
+		log:     l,
+		offsets: make(map[string]uint64),
+	}
+	if err = s.load(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the latest offset of every key back from the log.
+func (s *OffsetStore) load() error {
+	return s.log.scan(func(record *api.Record) error {
+		committed, err := strconv.ParseUint(string(record.Value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid committed offset at %d: %w", record.Offset, err)
+		}
+		s.offsets[string(record.Key)] = committed
+		return nil
+	})
+}
+
+// offsetKey returns the key the offsets of the given group, topic and partition
+// are stored under. Topic names can't contain NUL characters, group names are
+// checked not to.
+func offsetKey(group, topic string, partition uint32) string {
+	return fmt.Sprintf("%s\x00%s\x00%d", group, topic, partition)
+}
+
+// Commit stores the given offset for the group, topic and partition. By
+// convention, the offset is the one of the next record the group will consume.
+func (s *OffsetStore) Commit(group, topic string, partition uint32, offset uint64) error {
+	if group == "" || strings.ContainsRune(group, 0) {
+		return api.ErrInvalidGroup{Group: group}
+	}
+	key := offsetKey(group, topic, partition)
+
+	// Hold the lock while appending so that the log and the map agree on the
+	// latest offset of the key
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.log.Append(&api.Record{
+		Key:   []byte(key),
+		Value: []byte(strconv.FormatUint(offset, 10)),
+	})
+	if err != nil {
+		return err
+	}
+	s.offsets[key] = offset
+	return nil
+}
+
+// Fetch returns the offset last committed for the group, topic and partition,
+// or ErrNoCommittedOffset if the group has never committed any.
+func (s *OffsetStore) Fetch(group, topic string, partition uint32) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	offset, ok := s.offsets[offsetKey(group, topic, partition)]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{
+			Group:     group,
+			Topic:     topic,
+			Partition: partition,
+		}
+	}
+	return offset, nil
+}
+
+// Close closes the offset store's log.
+func (s *OffsetStore) Close() error {
+	return s.log.Close()
+}
@@ -0,0 +1,60 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func TestOffsetStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offset-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	s, err := NewOffsetStore(dir, c)
+	require.NoError(t, err)
+
+	_, err = s.Fetch("billing", "orders", 0)
+	require.Equal(t, api.ErrNoCommittedOffset{Group: "billing", Topic: "orders"}, err)
+
+	for _, name := range []string{"", "a\x00b"} {
+		err = s.Commit(name, "orders", 0, 1)
+		require.Equal(t, api.ErrInvalidGroup{Group: name}, err)
+	}
+
+	// Commit enough times for the log to roll over several segments
+	for off := uint64(1); off <= 20; off++ {
+		require.NoError(t, s.Commit("billing", "orders", 0, off))
+		require.NoError(t, s.Commit("billing", "orders", 1, 2*off))
+	}
+	require.NoError(t, s.Commit("shipping", "orders", 0, 5))
+	require.Greater(t, len(s.log.segments), 2)
+
+	require.NoError(t, s.log.Compact())
+	require.NoError(t, s.Close())
+
+	// The latest offsets are read back from the compacted log
+	s, err = NewOffsetStore(dir, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		group     string
+		partition uint32
+		want      uint64
+	}{
+		{"billing", 0, 20},
+		{"billing", 1, 40},
+		{"shipping", 0, 5},
+	} {
+		off, err := s.Fetch(tc.group, "orders", tc.partition)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, off)
+	}
+	_, err = s.Fetch("shipping", "orders", 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// producerWindow is how many of its most recent records are remembered for each
+// idempotent producer, i.e. how far back a producer can retry a record and
+// still get its original offset.
+const producerWindow = 5
+
+// producerState holds the sequence numbers and offsets of the most recent
+// records of an idempotent producer, from the oldest to the newest, along with
+// the timestamp of its last record.
+type producerState struct {
+	seqs      []uint64
+	offs      []uint64
+	timestamp int64
+}
+
+// checkSequence checks the sequence number of a record from an idempotent
+// producer against its previous records. For a retry of a recent record, it
+// returns the offset that record has been appended at, and reports that it is
+// a duplicate. The first record seen from a producer may have any sequence
+// number. It must be called with the active segment write-locked.
+func (l *Log) checkSequence(record *api.Record) (off uint64, duplicate bool, err error) {
+	if record.ProducerId == 0 {
+		return 0, false, nil
+	}
+	now := l.latestTimestamp
+	if record.Timestamp > now {
+		now = record.Timestamp
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok || l.producerExpired(p, now) {
+		return 0, false, nil
+	}
+
+	last := p.seqs[len(p.seqs)-1]
+	if record.Sequence == last+1 {
+		return 0, false, nil
+	}
+	for i, seq := range p.seqs {
+		if seq == record.Sequence {
+			return p.offs[i], true, nil
+		}
+	}
+	return 0, false, api.ErrOutOfOrderSequence{
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+		Expected:   last + 1,
+	}
+}
+
+// trackSequence remembers that the given record from an idempotent producer
+// has been appended at the given offset. It must be called with the active
+// segment write-locked, or while setting up the log.
+func (l *Log) trackSequence(record *api.Record, off uint64) {
+	if record.Timestamp > l.latestTimestamp {
+		l.latestTimestamp = record.Timestamp
+	}
+	if record.ProducerId == 0 {
+		return
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok || l.producerExpired(p, l.latestTimestamp) {
+		p = &producerState{}
+		l.producers[record.ProducerId] = p
+	}
+	p.timestamp = record.Timestamp
+	if len(p.seqs) == producerWindow {
+		p.seqs = p.seqs[1:]
+		p.offs = p.offs[1:]
+	}
+	p.seqs = append(p.seqs, record.Sequence)
+	p.offs = append(p.offs, off)
+}
+
+// producerExpired reports whether the given producer has been idle for longer
+// than the producer expiry as of the given timestamp. Producers expire against
+// the timestamps of the records rather than the clock, so that the replicas of
+// a log agree on which records are retries.
+func (l *Log) producerExpired(p *producerState, now int64) bool {
+	expiry := l.Config.Producers.Expiry
+	return expiry > 0 && now-p.timestamp > expiry.Milliseconds()
+}
+
+// expireProducers forgets the producers which expired as of the newest record
+// of the log. Since the newest timestamp only moves forward, they would be taken
+// for new producers anyway.
+func (l *Log) expireProducers() error {
+	s, err := l.lockActiveSegment()
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+
+	for id, p := range l.producers {
+		if l.producerExpired(p, l.latestTimestamp) {
+			delete(l.producers, id)
+		}
+	}
+	return nil
+}
+
+// runProducerExpiry periodically forgets the producers which expired, until the
+// log is closed.
+func (l *Log) runProducerExpiry() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.Config.Producers.Expiry / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := l.expireProducers(); err != nil {
+				zap.L().Named("log").Error(
+					"failed to expire idle producers",
+					zap.String("dir", l.Dir),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
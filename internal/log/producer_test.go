@@ -0,0 +1,152 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func producerRecord(id, seq uint64) *api.Record {
+	return &api.Record{
+		Value:      []byte("Hello World!"),
+		ProducerId: id,
+		Sequence:   seq,
+	}
+}
+
+// stamped sets the timestamp of the given record, in milliseconds.
+func stamped(record *api.Record, t time.Time) *api.Record {
+	record.Timestamp = t.UnixMilli()
+	return record
+}
+
+func TestLogProducerExpiry(t *testing.T) {
+	c := Config{}
+	c.Producers.Expiry = time.Hour
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+
+	start := time.Now().Add(-2 * time.Hour)
+	_, err := log.Append(stamped(producerRecord(7, 10), start))
+	require.NoError(t, err)
+	_, err = log.Append(stamped(producerRecord(8, 10), start.Add(30*time.Minute)))
+	require.NoError(t, err)
+
+	// Retries are recognized until the producer has been idle for too long
+	off, err := log.Append(stamped(producerRecord(7, 10), start.Add(30*time.Minute)))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// Producers expire against the timestamp of the newest record
+	_, err = log.Append(producerRecord(9, 0))
+	require.NoError(t, err)
+	require.NoError(t, log.expireProducers())
+	require.Len(t, log.producers, 1)
+	require.Contains(t, log.producers, uint64(9))
+
+	// The next record of an expired producer is taken for the first one of a
+	// new producer
+	off, err = log.Append(producerRecord(7, 10))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// Even before the expired producers have been forgotten, e.g. right after
+	// a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Contains(t, log.producers, uint64(8))
+	off, err = log.Append(producerRecord(8, 10))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	off, err = log.Append(producerRecord(7, 10))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLogIdempotentProducer(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+
+	for seq := uint64(10); seq < 13; seq++ {
+		off, err := log.Append(producerRecord(7, seq))
+		require.NoError(t, err)
+		require.Equal(t, seq-10, off)
+	}
+
+	// A retry gets the original offset without being appended again
+	off, err := log.Append(producerRecord(7, 11))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	// Sequence numbers can't skip ahead
+	_, err = log.Append(producerRecord(7, 14))
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: 7,
+		Sequence:   14,
+		Expected:   13,
+	}, err)
+
+	// Other producers and records without a producer are independent
+	off, err = log.Append(producerRecord(8, 0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = log.Append(producerRecord(0, 0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// Batches may hold retries, even of records from the same batch
+	offs, err := log.AppendBatch([]*api.Record{
+		producerRecord(7, 12),
+		producerRecord(7, 13),
+		producerRecord(7, 13),
+		producerRecord(8, 1),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 5, 5, 6}, offs)
+
+	// Only the most recent records are remembered
+	for seq := uint64(14); seq < 14+producerWindow; seq++ {
+		_, err = log.Append(producerRecord(7, seq))
+		require.NoError(t, err)
+	}
+	_, err = log.Append(producerRecord(7, 13))
+	require.Equal(t, api.ErrOutOfOrderSequence{
+		ProducerID: 7,
+		Sequence:   13,
+		Expected:   14 + producerWindow,
+	}, err)
+
+	// The state of the producers is rebuilt from the segments on restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	off, err = log.Append(producerRecord(8, 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	off, err = log.Append(producerRecord(7, 14+producerWindow))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7+producerWindow), off)
+
+	// And from the records of a restored log
+	restored := newTestLog(t, c)
+	defer os.RemoveAll(restored.Dir)
+	defer restored.Close()
+	reader := log.Reader()
+	defer reader.Close()
+	require.NoError(t, restored.Restore(reader))
+	off, err = restored.Append(producerRecord(8, 1))
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
@@ -0,0 +1,418 @@
+package log
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+const (
+	// Keys of the records of the queue's state log
+	nextKey        = "next"
+	leaseKeyPrefix = "lease/"
+
+	// Widths of the values of the state records
+	nextWidth       = 8
+	deliveriesWidth = 4
+	deadlineWidth   = 8
+	leaseWidth      = deliveriesWidth + deadlineWidth
+
+	// Headers added to the records moved to the dead-letter log
+	deadLetterOffsetHeader     = "dead-letter-offset"
+	deadLetterDeliveriesHeader = "dead-letter-deliveries"
+)
+
+// Queue delivers the records of a log to consumers as a work queue, rather than
+// leaving it up to them to keep track of offsets.
+//
+// Consumers lease records one at a time. A leased record is hidden from the
+// other consumers until the visibility timeout elapses, after which it is
+// delivered again unless the consumer has acked it in the meantime. A consumer
+// can also nack a record to have it delivered again right away. Leases are
+// acked and nacked along with their number of deliveries, so that a consumer
+// whose lease expired can't ack or nack the record once it is delivered again. A record
+// delivered the maximum number of times without being acked is moved to the
+// dead-letter log instead.
+//
+// The queue only delivers the records of committed transactions, along with
+// the records outside of transactions.
+//
+// The offset of the next record to deliver for the first time and the leases
+// of the records delivered but not acked yet are stored in a compacted log, so
+// that they survive a restart. Acked leases are removed from it with
+// tombstones.
+type Queue struct {
+	Config
+
+	log        *Log
+	deadLetter *Log
+	state      *Log
+
+	mu     sync.Mutex
+	next   uint64
+	leases map[uint64]lease
+	// nacked is closed and replaced every time a record is nacked, see Watch
+	nacked chan struct{}
+}
+
+// lease is a record delivered but not acked yet.
+type lease struct {
+	deliveries uint32
+	deadline   time.Time
+}
+
+// Delivery is a record leased from the queue.
+type Delivery struct {
+	Record *api.Record
+	// Deliveries is how many times the record has been delivered, this one
+	// included.
+	Deliveries uint32
+	// Deadline is when the lease expires.
+	Deadline time.Time
+}
+
+// NewQueue creates a queue over the given log, keeping its state and its
+// dead-letter log in the given directory, or opens the existing one.
+func NewQueue(l *Log, dir string, c Config) (*Queue, error) {
+	if c.Queue.VisibilityTimeout == 0 {
+		c.Queue.VisibilityTimeout = 30 * time.Second
+	}
+	if c.Queue.MaxDeliveries == 0 {
+		c.Queue.MaxDeliveries = 5
+	}
+	q := &Queue{
+		Config: c,
+		log:    l,
+		leases: make(map[uint64]lease),
+		nacked: make(chan struct{}),
+	}
+
+	stateDir := path.Join(dir, "state")
+	deadLetterDir := path.Join(dir, "dead-letter")
+	for _, d := range []string{stateDir, deadLetterDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if q.state, err = NewLog(stateDir, compacted(c)); err != nil {
+		return nil, err
+	}
+	if q.deadLetter, err = NewLog(deadLetterDir, c); err != nil {
+		q.state.Close()
+		return nil, err
+	}
+	if err = q.load(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the next offset and the leases back from the state log.
+func (q *Queue) load() error {
+	return q.state.scan(func(record *api.Record) error {
+		key := string(record.Key)
+		switch {
+		case key == nextKey:
+			if len(record.Value) != nextWidth {
+				return fmt.Errorf("invalid next offset at %d", record.Offset)
+			}
+			q.next = binary.BigEndian.Uint64(record.Value)
+		case strings.HasPrefix(key, leaseKeyPrefix):
+			off, err := strconv.ParseUint(strings.TrimPrefix(key, leaseKeyPrefix), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid lease key at %d: %w", record.Offset, err)
+			}
+			if len(record.Value) == 0 {
+				delete(q.leases, off)
+				return nil
+			}
+			if len(record.Value) != leaseWidth {
+				return fmt.Errorf("invalid lease at %d", record.Offset)
+			}
+			q.leases[off] = lease{
+				deliveries: binary.BigEndian.Uint32(record.Value),
+				deadline: time.UnixMilli(int64(
+					binary.BigEndian.Uint64(record.Value[deliveriesWidth:]),
+				)),
+			}
+		}
+		return nil
+	})
+}
+
+// Lease delivers the next record of the queue. Records whose lease has expired
+// are delivered again first, in order of offset, before the records which
+// haven't been delivered yet. It returns ErrOffsetOutOfRange if there is no
+// record to deliver, see Watch to wait for one.
+func (q *Queue) Lease() (*Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, off := range q.expired(now) {
+		l := q.leases[off]
+		record, err := q.log.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange, api.ErrOffsetCompacted:
+			// The record is gone from the log, there is nothing to deliver
+			if err = q.forget(off); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, err
+		}
+
+		if l.deliveries >= q.Config.Queue.MaxDeliveries {
+			if err = q.moveToDeadLetter(record, l); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return q.deliver(record, l.deliveries+1, now)
+	}
+
+	for {
+		record, err := q.log.ReadCommitted(q.next)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// The records up to the lowest offset may have been removed from
+			// the log before being delivered
+			lowest, err := q.log.LowestOffset()
+			if err != nil {
+				return nil, err
+			}
+			if q.next < lowest {
+				q.next = lowest
+				continue
+			}
+			return nil, api.ErrOffsetOutOfRange{Offset: q.next}
+		case api.ErrOffsetCompacted, api.ErrRecordNotVisible:
+			q.next++
+			continue
+		default:
+			return nil, err
+		}
+		return q.deliver(record, 1, now)
+	}
+}
+
+// expired returns the offsets of the leases which have expired at the given
+// time, in order. It must be called with the lock held.
+func (q *Queue) expired(now time.Time) []uint64 {
+	var offs []uint64
+	for off, l := range q.leases {
+		if !l.deadline.After(now) {
+			offs = append(offs, off)
+		}
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	return offs
+}
+
+// deliver leases the record until the visibility timeout elapses. It must be
+// called with the lock held.
+func (q *Queue) deliver(record *api.Record, deliveries uint32, now time.Time) (
+	*Delivery, error,
+) {
+	off := record.Offset
+	l := lease{
+		deliveries: deliveries,
+		deadline:   now.Add(q.Config.Queue.VisibilityTimeout),
+	}
+	records := []*api.Record{leaseRecord(off, l)}
+	next := q.next
+	if off >= next {
+		next = off + 1
+		records = append(records, nextRecord(next))
+	}
+	if _, err := q.state.AppendBatch(records); err != nil {
+		return nil, err
+	}
+
+	q.leases[off] = l
+	q.next = next
+	return &Delivery{
+		Record:     record,
+		Deliveries: l.deliveries,
+		Deadline:   l.deadline,
+	}, nil
+}
+
+// moveToDeadLetter appends the record, which has been delivered too many times,
+// to the dead-letter log and forgets about it. The record keeps track of its
+// offset and number of deliveries in its headers. It must be called with the
+// lock held.
+func (q *Queue) moveToDeadLetter(record *api.Record, l lease) error {
+	// The record isn't part of a producer's sequence nor of a transaction in
+	// the dead-letter log
+	dead := &api.Record{
+		Value:     record.Value,
+		Key:       record.Key,
+		Timestamp: record.Timestamp,
+		Headers: append(
+			record.Headers,
+			&api.Header{
+				Key:   deadLetterOffsetHeader,
+				Value: []byte(strconv.FormatUint(record.Offset, 10)),
+			},
+			&api.Header{
+				Key:   deadLetterDeliveriesHeader,
+				Value: []byte(strconv.FormatUint(uint64(l.deliveries), 10)),
+			},
+		),
+	}
+	if _, err := q.deadLetter.Append(dead); err != nil {
+		return err
+	}
+	return q.forget(record.Offset)
+}
+
+// forget removes the lease of the record with a tombstone. It must be called
+// with the lock held.
+func (q *Queue) forget(off uint64) error {
+	if _, err := q.state.Append(&api.Record{Key: leaseKey(off)}); err != nil {
+		return err
+	}
+	delete(q.leases, off)
+	return nil
+}
+
+// Ack acknowledges that the record at the given offset has been processed, so
+// that it isn't delivered again. The lease is the one of the given delivery of
+// the record, see Delivery.Deliveries. It returns ErrLeaseNotFound if the
+// record isn't leased, and ErrStaleLease if it has been delivered again since.
+func (q *Queue) Ack(off uint64, deliveries uint32) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, err := q.lease(off, deliveries); err != nil {
+		return err
+	}
+	return q.forget(off)
+}
+
+// Nack gives the record at the given offset back to the queue, so that it is
+// delivered again right away. The lease is the one of the given delivery of
+// the record, see Ack.
+func (q *Queue) Nack(off uint64, deliveries uint32) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, err := q.lease(off, deliveries)
+	if err != nil {
+		return err
+	}
+	l.deadline = time.Now()
+	if _, err = q.state.Append(leaseRecord(off, l)); err != nil {
+		return err
+	}
+	q.leases[off] = l
+
+	close(q.nacked)
+	q.nacked = make(chan struct{})
+	return nil
+}
+
+// lease returns the lease of the record at the given offset, provided it is
+// the one of the given delivery. An expired lease can still be acked or nacked
+// as long as the record hasn't been delivered again. It must be called with the
+// lock held.
+func (q *Queue) lease(off uint64, deliveries uint32) (lease, error) {
+	l, ok := q.leases[off]
+	if !ok {
+		return lease{}, api.ErrLeaseNotFound{Offset: off}
+	}
+	if l.deliveries != deliveries {
+		return lease{}, api.ErrStaleLease{
+			Offset:     off,
+			Deliveries: deliveries,
+			Current:    l.deliveries,
+		}
+	}
+	return l, nil
+}
+
+// Watch returns a channel that is closed once there may be a record to lease,
+// i.e. when a record is appended to the log or nacked, or when a lease expires,
+// or once done is closed.
+func (q *Queue) Watch(done <-chan struct{}) <-chan struct{} {
+	q.mu.Lock()
+	appended := q.log.WatchCommitted(q.next)
+	nacked := q.nacked
+	var earliest time.Time
+	for _, l := range q.leases {
+		if earliest.IsZero() || l.deadline.Before(earliest) {
+			earliest = l.deadline
+		}
+	}
+	q.mu.Unlock()
+
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		var expired <-chan time.Time
+		if !earliest.IsZero() {
+			timer := time.NewTimer(time.Until(earliest))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-done:
+		case <-appended:
+		case <-nacked:
+		case <-expired:
+		}
+	}()
+	return ch
+}
+
+// DeadLetter returns the log the records delivered too many times are moved
+// to.
+func (q *Queue) DeadLetter() *Log {
+	return q.deadLetter
+}
+
+// Close closes the queue's state and dead-letter logs. The log the records are
+// delivered from is left open.
+func (q *Queue) Close() error {
+	if err := q.deadLetter.Close(); err != nil {
+		return err
+	}
+	return q.state.Close()
+}
+
+// leaseKey returns the key the lease of the record at the given offset is
+// stored under.
+func leaseKey(off uint64) []byte {
+	return []byte(leaseKeyPrefix + strconv.FormatUint(off, 10))
+}
+
+// leaseRecord returns the record storing the lease of the record at the given
+// offset.
+func leaseRecord(off uint64, l lease) *api.Record {
+	value := make([]byte, leaseWidth)
+	binary.BigEndian.PutUint32(value, l.deliveries)
+	binary.BigEndian.PutUint64(value[deliveriesWidth:], uint64(l.deadline.UnixMilli()))
+	return &api.Record{Key: leaseKey(off), Value: value}
+}
+
+// nextRecord returns the record storing the offset of the next record to
+// deliver for the first time.
+func nextRecord(next uint64) *api.Record {
+	value := make([]byte, nextWidth)
+	binary.BigEndian.PutUint64(value, next)
+	return &api.Record{Key: []byte(nextKey), Value: value}
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func TestQueue(t *testing.T) {
+	dir, err := os.MkdirTemp("", "queue-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Queue.VisibilityTimeout = 100 * time.Millisecond
+	c.Queue.MaxDeliveries = 2
+	l := newTestLog(t, c)
+	defer os.RemoveAll(l.Dir)
+	defer l.Close()
+	for _, value := range []string{"a", "b", "c"} {
+		_, err := l.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+
+	q, err := NewQueue(l, dir, c)
+	require.NoError(t, err)
+
+	lease := func(want uint64, deliveries uint32) {
+		t.Helper()
+		d, err := q.Lease()
+		require.NoError(t, err)
+		require.Equal(t, want, d.Record.Offset)
+		require.Equal(t, deliveries, d.Deliveries)
+	}
+
+	lease(0, 1)
+	lease(1, 1)
+	require.NoError(t, q.Ack(1, 1))
+	require.Equal(t, api.ErrLeaseNotFound{Offset: 1}, q.Ack(1, 1))
+
+	// A nacked record is delivered again right away
+	require.NoError(t, q.Nack(0, 1))
+	lease(0, 2)
+	lease(2, 1)
+	_, err = q.Lease()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	// The leases survive a restart
+	require.NoError(t, q.Close())
+	q, err = NewQueue(l, dir, c)
+	require.NoError(t, err)
+	defer q.Close()
+	_, err = q.Lease()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	// Once the leases expire, the record delivered too many times goes to the
+	// dead-letter log and the other one is delivered again
+	<-q.Watch(nil)
+	time.Sleep(10 * time.Millisecond)
+	lease(2, 2)
+	dead, err := q.DeadLetter().Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), dead.Value)
+	require.Len(t, dead.Headers, 2)
+	require.Equal(t, deadLetterOffsetHeader, dead.Headers[0].Key)
+	require.Equal(t, []byte("0"), dead.Headers[0].Value)
+	require.Equal(t, deadLetterDeliveriesHeader, dead.Headers[1].Key)
+	require.Equal(t, []byte("2"), dead.Headers[1].Value)
+	require.NoError(t, q.Ack(2, 2))
+
+	// Watch fires once a record is appended
+	watch := q.Watch(nil)
+	_, err = l.Append(&api.Record{Value: []byte("d")})
+	require.NoError(t, err)
+	select {
+	case <-watch:
+	case <-time.After(time.Second):
+		t.Fatal("watch didn't fire on append")
+	}
+	lease(3, 1)
+}
+
+func TestQueueStaleLease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "queue-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Queue.VisibilityTimeout = 50 * time.Millisecond
+	l := newTestLog(t, c)
+	defer os.RemoveAll(l.Dir)
+	defer l.Close()
+	_, err = l.Append(&api.Record{Value: []byte("a")})
+	require.NoError(t, err)
+
+	q, err := NewQueue(l, dir, c)
+	require.NoError(t, err)
+	defer q.Close()
+
+	first, err := q.Lease()
+	require.NoError(t, err)
+
+	// The lease expires and the record is leased again, by another consumer
+	<-q.Watch(nil)
+	time.Sleep(10 * time.Millisecond)
+	second, err := q.Lease()
+	require.NoError(t, err)
+	require.Equal(t, first.Record.Offset, second.Record.Offset)
+	require.Equal(t, uint32(2), second.Deliveries)
+
+	// The first consumer no longer owns the record
+	stale := api.ErrStaleLease{Offset: 0, Deliveries: 1, Current: 2}
+	require.Equal(t, stale, q.Ack(0, first.Deliveries))
+	require.Equal(t, stale, q.Nack(0, first.Deliveries))
+	_, err = q.Lease()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+
+	require.NoError(t, q.Ack(0, second.Deliveries))
+}
@@ -0,0 +1,193 @@
+package log
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// Replicator copies the records of other servers into the local log, at the
+// same offsets, so that the local server follows the leader.
+//
+// Each server joined is replicated with a ConsumeStream of its default log,
+// starting from the last record of the local log, so that replication resumes
+// where it left off after a restart. Records the local log already has are
+// ignored, which allows joining other followers of the leader along with it:
+// whichever is ahead supplies the next records. Replication starts over after
+// the stream fails, until the server leaves or the replicator is closed.
+type Replicator struct {
+	// DialOptions configure the client connections to the other servers, e.g.
+	// with the replicator's own client certificate.
+	DialOptions []grpc.DialOption
+	// Log is the local log the records are replicated into.
+	Log *Log
+	// RetryInterval is how long to wait before starting over after a failed
+	// stream, one second when zero.
+	RetryInterval time.Duration
+
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// servers maps the names of the servers being replicated to channels
+	// closed when they leave
+	servers map[string]chan struct{}
+	closed  bool
+	close   chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Join starts replicating the server with the given name and address. Joining
+// a server already being replicated does nothing.
+func (r *Replicator) Join(name, addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	if r.closed {
+		return nil
+	}
+	if _, ok := r.servers[name]; ok {
+		return nil
+	}
+	leave := make(chan struct{})
+	r.servers[name] = leave
+
+	r.wg.Add(1)
+	go r.replicate(addr, leave)
+	return nil
+}
+
+// replicate replicates the server at the given address until it leaves or the
+// replicator is closed.
+func (r *Replicator) replicate(addr string, leave chan struct{}) {
+	defer r.wg.Done()
+
+	for {
+		err := r.stream(addr, leave)
+		if err == nil {
+			return
+		}
+		r.logger.Error(
+			"failed to replicate",
+			zap.String("addr", addr),
+			zap.Error(err),
+		)
+
+		select {
+		case <-leave:
+			return
+		case <-r.close:
+			return
+		case <-time.After(r.RetryInterval):
+		}
+	}
+}
+
+// stream appends the records consumed from the server at the given address to
+// the local log. It returns nil once the server leaves or the replicator is
+// closed, and the error the stream failed with otherwise.
+func (r *Replicator) stream(addr string, leave chan struct{}) error {
+	cc, err := grpc.Dial(addr, r.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-leave:
+		case <-r.close:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	// Start from the last local record, unless the server has removed it
+	// already, in which case the records in between can't be replicated
+	client := api.NewLogClient(cc)
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return r.streamError(ctx, err)
+	}
+	off, err := r.Log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if off < offsets.LowestOffset {
+		off = offsets.LowestOffset
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: off})
+	if err != nil {
+		return r.streamError(ctx, err)
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return r.streamError(ctx, err)
+		}
+		if err = r.Log.AppendAt(res.Record); err != nil {
+			return err
+		}
+	}
+}
+
+// streamError returns the given error of a stream, or nil if it failed because
+// the stream was canceled on purpose.
+func (r *Replicator) streamError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Leave stops replicating the server with the given name.
+func (r *Replicator) Leave(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+
+	if leave, ok := r.servers[name]; ok {
+		close(leave)
+		delete(r.servers, name)
+	}
+	return nil
+}
+
+// init lazily initializes the replicator, so that its zero value, along with
+// the exported fields, is ready to use. It must be called with the lock held.
+func (r *Replicator) init() {
+	if r.logger == nil {
+		r.logger = zap.L().Named("replicator")
+	}
+	if r.servers == nil {
+		r.servers = make(map[string]chan struct{})
+	}
+	if r.close == nil {
+		r.close = make(chan struct{})
+	}
+	if r.RetryInterval == 0 {
+		r.RetryInterval = time.Second
+	}
+}
+
+// Close stops replicating all servers and waits for the replication to stop.
+// The local log is left open.
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	r.init()
+	if !r.closed {
+		r.closed = true
+		close(r.close)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	return nil
+}
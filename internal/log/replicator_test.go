@@ -0,0 +1,143 @@
+package log_test
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"github.com/tkhoa2711/proglog/internal/auth"
+	"github.com/tkhoa2711/proglog/internal/config"
+	"github.com/tkhoa2711/proglog/internal/log"
+	"github.com/tkhoa2711/proglog/internal/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestReplicator(t *testing.T) {
+	leader, leaderAddr := setupServer(t)
+	follower, followerAddr := setupServer(t)
+	chained, _ := setupServer(t)
+
+	for _, value := range []string{"a", "b", "c"} {
+		_, err := leader.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	// Offsets 3 and 4 are missing, as if compacted
+	require.NoError(t, leader.AppendAt(&api.Record{Value: []byte("f"), Offset: 5}))
+
+	// The follower replicates the leader, and is replicated in turn
+	r := newReplicator(t, follower)
+	require.NoError(t, r.Join("leader", leaderAddr))
+	chainedReplicator := newReplicator(t, chained)
+	defer chainedReplicator.Close()
+	require.NoError(t, chainedReplicator.Join("follower", followerAddr))
+
+	want := map[uint64]string{0: "a", 1: "b", 2: "c", 5: "f"}
+	for _, l := range []*log.Log{follower, chained} {
+		requireReplicated(t, l, want)
+		_, err := l.Read(3)
+		require.Equal(t, api.ErrOffsetCompacted{Offset: 3}, err)
+	}
+
+	// A new replicator resumes from the last record of the follower
+	require.NoError(t, r.Close())
+	off, err := leader.Append(&api.Record{Value: []byte("g")})
+	require.NoError(t, err)
+	want[off] = "g"
+	r = newReplicator(t, follower)
+	defer r.Close()
+	require.NoError(t, r.Join("leader", leaderAddr))
+	require.NoError(t, r.Join("leader", leaderAddr))
+
+	for _, l := range []*log.Log{follower, chained} {
+		requireReplicated(t, l, want)
+		highest, err := l.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, off, highest)
+	}
+
+	// Records stop being replicated once the leader leaves
+	require.NoError(t, r.Leave("leader"))
+	time.Sleep(50 * time.Millisecond)
+	off, err = leader.Append(&api.Record{Value: []byte("h")})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = follower.Read(off)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+}
+
+// requireReplicated waits for the log to hold the given values at the given
+// offsets.
+func requireReplicated(t *testing.T, l *log.Log, want map[uint64]string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		for off, value := range want {
+			record, err := l.Read(off)
+			if err != nil || string(record.Value) != value {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// setupServer runs a server for a new log on localhost, which are torn down
+// along with the test.
+func setupServer(t *testing.T) (*log.Log, string) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "replicator-test")
+	require.NoError(t, err)
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: ln.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(
+		&server.Config{
+			CommitLog:  l,
+			Authorizer: auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		},
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	go srv.Serve(ln)
+
+	t.Cleanup(func() {
+		srv.Stop()
+		l.Close()
+		os.RemoveAll(dir)
+	})
+	return l, ln.Addr().String()
+}
+
+// newReplicator returns a replicator into the given log, which connects to the
+// other servers with the replicator's client certificate.
+func newReplicator(t *testing.T, l *log.Log) *log.Replicator {
+	t.Helper()
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ReplicatorClientCertFile,
+		KeyFile:  config.ReplicatorClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	return &log.Replicator{
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+		},
+		Log:           l,
+		RetryInterval: 10 * time.Millisecond,
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"sort"
+	"sync"
+	"time"
 
 	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -14,11 +18,27 @@ import (
 //
 // The base offset tells us where the segment starts. The next offset allows us
 // to know where to append new records.
+//
+// The time index maps timestamps to the relative offsets of the records. Its
+// entries reuse the index's layout, with the timestamp in place of the position.
+// An entry is only added for a record whose timestamp is greater than all the
+// previous ones, so that the time index can be binary-searched.
+//
+// The lock guards reads of the segment against appends and against closing it.
+// Appends require the caller to hold the write lock, whereas reads take the
+// read lock by themselves. Once sealed, the segment doesn't accept appends
+// anymore, so its write lock is only ever taken to close it.
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *index
 	baseOffset, nextOffset uint64
+	maxTimestamp           int64
 	config                 Config
+
+	mu     sync.RWMutex
+	sealed bool
+	closed bool
 }
 
 // newSegment creates a new segment in the given directory with the given base
@@ -56,46 +76,238 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	// Create the time index
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newIndex(timeIndexFile, c); err != nil {
+		return nil, err
+	}
+
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
+
 	// Determine the next offset to append new records
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	if _, ts, err := s.timeIndex.Read(-1); err == nil {
+		s.maxTimestamp = int64(ts)
+	}
 
 	return s, nil
 }
 
-// Append writes the record to the segment and returns its offset.
+// recover brings the segment back to a consistent state after an ungraceful
+// shutdown. A torn or corrupt record at the end of the store is discarded, a
+// corrupt record followed by intact ones fails the recovery instead, and the
+// indexes are rebuilt from the store if they don't agree with each other,
+// e.g. when an index file is missing or has not been trimmed on close.
+func (s *segment) recover() error {
+	logger := zap.L().Named("log")
+
+	positions, discarded, err := s.store.Repair()
+	if err != nil {
+		return err
+	}
+	if discarded > 0 {
+		logger.Warn(
+			"discarded corrupt data at the end of the store",
+			zap.String("store", s.store.Name()),
+			zap.Uint64("discarded_bytes", discarded),
+		)
+	}
+
+	if s.indexMatches(positions) && s.timeIndexMatches(positions) {
+		return nil
+	}
+	logger.Warn(
+		"rebuilding indexes from the store",
+		zap.String("index", s.index.Name()),
+		zap.Uint64("index_entries", s.index.size/entryWidth),
+		zap.Int("store_records", len(positions)),
+	)
+	return s.rebuildIndexes(positions)
+}
+
+// indexMatches reports whether the index holds exactly one entry for each of
+// the given store positions, in order of increasing relative offset. Offsets
+// aren't necessarily contiguous since compaction leaves gaps between them.
+func (s *segment) indexMatches(positions []uint64) bool {
+	if s.index.size != uint64(len(positions))*entryWidth {
+		return false
+	}
+	var prev uint32
+	for n, want := range positions {
+		off, pos, err := s.index.Read(int64(n))
+		if err != nil || pos != want || (n > 0 && off <= prev) {
+			return false
+		}
+		prev = off
+	}
+	return true
+}
+
+// timeIndexMatches reports whether the time index is consistent with the
+// records stored at the given positions, i.e. both its offsets and timestamps
+// are increasing, its offsets are within the index, and it covers the
+// timestamp of the last record. It assumes the index itself matches.
+func (s *segment) timeIndexMatches(positions []uint64) bool {
+	last, _, err := s.index.Read(-1)
+	if err != nil && s.timeIndex.size > 0 {
+		return false
+	}
+
+	var prevOff, prevTs uint64
+	for n := int64(0); uint64(n)*entryWidth < s.timeIndex.size; n++ {
+		off, ts, err := s.timeIndex.Read(n)
+		if err != nil || off > last {
+			return false
+		}
+		if n > 0 && (off <= uint32(prevOff) || ts <= prevTs) {
+			return false
+		}
+		prevOff, prevTs = uint64(off), ts
+	}
+
+	if len(positions) == 0 {
+		return true
+	}
+	record, err := s.readAt(positions[len(positions)-1])
+	return err == nil && uint64(record.Timestamp) <= prevTs
+}
+
+// rebuildIndexes regenerates the index and the time index from the records
+// stored at the given positions. The relative offsets are taken from the
+// records themselves, as they may have gaps in compacted segments.
+func (s *segment) rebuildIndexes(positions []uint64) error {
+	s.index.Reset()
+	s.timeIndex.Reset()
+	s.maxTimestamp = 0
+	for _, pos := range positions {
+		record, err := s.readAt(pos)
+		if err != nil {
+			return err
+		}
+		if record.Offset < s.baseOffset {
+			return fmt.Errorf(
+				"record offset %d is lower than the segment's base offset %d",
+				record.Offset,
+				s.baseOffset,
+			)
+		}
+		off := uint32(record.Offset - s.baseOffset)
+		if err = s.index.Write(off, pos); err != nil {
+			return err
+		}
+		if err = s.indexTimestamp(off, record.Timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexTimestamp adds an entry to the time index if the record at the given
+// relative offset is more recent than all the previous ones.
+func (s *segment) indexTimestamp(off uint32, ts int64) error {
+	if ts <= s.maxTimestamp {
+		return nil
+	}
+	if err := s.timeIndex.Write(off, uint64(ts)); err != nil {
+		return err
+	}
+	s.maxTimestamp = ts
+	return nil
+}
+
+// Append writes the record to the segment, compressed with the configured
+// codec, and returns its offset. Records without a timestamp get stamped with
+// the current time. It must be called with the write lock held.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
-	cur := s.nextOffset
-	record.Offset = cur
+	record.Offset = s.nextOffset
+	return s.AppendAt(record)
+}
+
+// AppendAt writes the record to the segment at its own offset, which must not
+// be lower than the next offset, see Append. The offsets skipped in between are
+// left as a gap, as if compacted. It must be called with the write lock held.
+func (s *segment) AppendAt(record *api.Record) (offset uint64, err error) {
+	cur := record.Offset
+	if cur < s.nextOffset {
+		return 0, fmt.Errorf(
+			"record offset %d is lower than the segment's next offset %d",
+			cur,
+			s.nextOffset,
+		)
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixMilli()
+	}
 	b, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	b, codec, err := compress(s.config.Compression.Codec, b)
+	if err != nil {
+		return 0, err
+	}
 
-	_, pos, err := s.store.Append(b)
+	_, pos, err := s.store.Append(b, codec)
 	if err != nil {
 		return 0, err
 	}
 
-	if err = s.index.Write(uint32(s.nextOffset-s.baseOffset), pos); err != nil {
+	if err = s.index.Write(uint32(cur-s.baseOffset), pos); err != nil {
+		return 0, err
+	}
+	if err = s.indexTimestamp(uint32(cur-s.baseOffset), record.Timestamp); err != nil {
 		return 0, err
 	}
 
-	s.nextOffset++
+	s.nextOffset = cur + 1
 	return cur, nil
 }
 
-// Read returns the record for the given offset.
+// Read returns the record for the given offset. It returns ErrOffsetCompacted
+// if the record has been removed by compaction.
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// The segment may have been removed from the log in the meantime
+	if s.closed || off < s.baseOffset || off >= s.nextOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+
+	pos, ok := s.index.Find(uint32(off - s.baseOffset))
+	if !ok {
+		return nil, api.ErrOffsetCompacted{Offset: off}
+	}
+
+	return s.readAt(pos)
+}
+
+// readAt returns the record stored at the given position in the store.
+func (s *segment) readAt(pos uint64) (*api.Record, error) {
+	b, codec, err := s.store.Read(pos)
 	if err != nil {
 		return nil, err
 	}
+	return unmarshalRecord(b, codec)
+}
 
-	b, err := s.store.Read(pos)
+// unmarshalRecord decompresses the given data with the codec it was stored
+// with and unmarshals the record out of it.
+func unmarshalRecord(b []byte, codec Codec) (*api.Record, error) {
+	b, err := decompress(codec, b)
 	if err != nil {
 		return nil, err
 	}
@@ -108,31 +320,143 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, nil
 }
 
+// OffsetForTimestamp returns the offset of the first record whose timestamp,
+// in Unix milliseconds, is at or after the given one. It reports false if there
+// is no such record in the segment.
+func (s *segment) OffsetForTimestamp(ts int64) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed || ts > s.maxTimestamp {
+		return 0, false
+	}
+	n := int(s.timeIndex.size / entryWidth)
+	i := sort.Search(n, func(i int) bool {
+		_, t, _ := s.timeIndex.Read(int64(i))
+		return int64(t) >= ts
+	})
+	off, _, err := s.timeIndex.Read(int64(i))
+	if err != nil {
+		return 0, false
+	}
+	return s.baseOffset + uint64(off), true
+}
+
+// truncate removes the records at the given offset and above from the segment,
+// so that the next record appended gets the given offset. It must be called
+// with the write lock held.
+func (s *segment) truncate(off uint64) error {
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	rel := uint32(off - s.baseOffset)
+	kept := func(i *index) int64 {
+		n := int(i.size / entryWidth)
+		return int64(sort.Search(n, func(j int) bool {
+			o, _, _ := i.Read(int64(j))
+			return o >= rel
+		}))
+	}
+
+	n := kept(s.index)
+	if _, pos, err := s.index.Read(n); err == nil {
+		if err = s.store.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	s.index.size = uint64(n) * entryWidth
+
+	s.timeIndex.size = uint64(kept(s.timeIndex)) * entryWidth
+	s.maxTimestamp = 0
+	if _, ts, err := s.timeIndex.Read(-1); err == nil {
+		s.maxTimestamp = int64(ts)
+	}
+
+	if off < s.nextOffset {
+		s.nextOffset = off
+	}
+	return nil
+}
+
+// Sync commits the segment's store and then its indexes to stable storage, so
+// that the indexes never point to records which haven't been persisted.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
 // Close closes the segment's store and index files.
 func (s *segment) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close()
+}
+
+// close closes the segment's store and index files. It must be called with the
+// write lock held.
+func (s *segment) close() error {
+	if s.closed {
+		return nil
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	s.closed = true
 	return nil
 }
 
 // Remove closes the segment and remove all of its store and index files.
 func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove()
+}
+
+// remove closes the segment and remove all of its store and index files. It
+// must be called with the write lock held.
+func (s *segment) remove() error {
+	if err := s.close(); err != nil {
 		return err
 	}
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Size returns the number of bytes taken up by the segment's records.
+func (s *segment) Size() uint64 {
+	return s.store.Size()
+}
+
+// ModTime returns the last time the segment's store was written to. If that
+// can't be determined, the current time is returned so that the segment is
+// considered recent.
+func (s *segment) ModTime() time.Time {
+	fi, err := s.store.Stat()
+	if err != nil {
+		return time.Now()
+	}
+	return fi.ModTime()
+}
+
 // IsMaxed checks if the segment has reached its size limit, either for the
 // store or the index.
 func (s *segment) IsMaxed() bool {
@@ -57,13 +57,13 @@ func TestNewSegment(t *testing.T) {
 }
 
 func TestNewSegmentRehydrateFromExistingState(t *testing.T) {
-	t.Skip("FIXME")
 	var baseOffset = uint64(16)
 	record := &api.Record{Value: []byte("Hello World!")}
 
 	s, dir, err := makeSegmentWithSomeData(baseOffset, record)
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
+	require.NoError(t, s.Close())
 
 	c := Config{}
 	c.Segment.MaxStoreBytes = uint64(len(record.Value) * 3)
@@ -72,6 +72,103 @@ func TestNewSegmentRehydrateFromExistingState(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, s.index.size, s2.index.size)
 	require.Equal(t, s.store.size, s2.store.size)
+	require.Equal(t, s.nextOffset, s2.nextOffset)
+}
+
+func TestNewSegmentRebuildIndex(t *testing.T) {
+	for scenario, corrupt := range map[string]func(t *testing.T, s *segment){
+		"missing index": func(t *testing.T, s *segment) {
+			require.NoError(t, os.Remove(s.index.Name()))
+		},
+		"untrimmed index": func(t *testing.T, s *segment) {
+			// The process died before the index got trimmed on close
+			err := os.Truncate(s.index.Name(), int64(entryWidth*3))
+			require.NoError(t, err)
+		},
+		"missing time index": func(t *testing.T, s *segment) {
+			require.NoError(t, os.Remove(s.timeIndex.Name()))
+		},
+		"index out of sync": func(t *testing.T, s *segment) {
+			f, err := os.OpenFile(s.index.Name(), os.O_RDWR, 0644)
+			require.NoError(t, err)
+			defer f.Close()
+			pos := make([]byte, posWidth)
+			encoding.PutUint64(pos, 1)
+			_, err = f.WriteAt(pos, int64(entryWidth+offWidth))
+			require.NoError(t, err)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			var baseOffset = uint64(16)
+			record := &api.Record{Value: []byte("Hello World!")}
+
+			s, dir, err := makeSegment(baseOffset)
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			for i := 0; i < 2; i++ {
+				_, err = s.Append(&api.Record{
+					Value:     record.Value,
+					Timestamp: int64(1000 + i),
+				})
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Close())
+			corrupt(t, s)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+			s, err = newSegment(dir, baseOffset, c)
+			require.NoError(t, err)
+			require.Equal(t, 2*entryWidth, s.index.size)
+			require.Equal(t, baseOffset+2, s.nextOffset)
+
+			for i := uint64(0); i < 2; i++ {
+				got, err := s.Read(baseOffset + i)
+				require.NoError(t, err)
+				require.Equal(t, baseOffset+i, got.Offset)
+
+				off, ok := s.OffsetForTimestamp(int64(1000 + i))
+				require.True(t, ok)
+				require.Equal(t, baseOffset+i, off)
+			}
+		})
+	}
+}
+
+func TestNewSegmentRecoverFromTornWrite(t *testing.T) {
+	var baseOffset = uint64(16)
+	record := &api.Record{Value: []byte("Hello World!")}
+
+	s, dir, err := makeSegmentWithSomeData(baseOffset, record)
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	storeSize := s.store.size
+	require.NoError(t, s.Close())
+
+	// Simulate a crash in the middle of writing the last record
+	err = os.Truncate(s.store.Name(), int64(storeSize)-3)
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	s, err = newSegment(dir, baseOffset, c)
+	require.NoError(t, err)
+	require.Equal(t, baseOffset+2, s.nextOffset)
+	require.Equal(t, 2*entryWidth, s.index.size)
+
+	for i := uint64(0); i < 2; i++ {
+		got, err := s.Read(baseOffset + i)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+	}
+
+	off, err := s.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, baseOffset+2, off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, got.Value)
 }
 
 func TestSegmentAppend(t *testing.T) {
@@ -139,6 +236,9 @@ func TestSegmentRemove(t *testing.T) {
 	if _, err := os.Stat(s.index.Name()); !errors.Is(err, os.ErrNotExist) {
 		require.NoError(t, err)
 	}
+	if _, err := os.Stat(s.timeIndex.Name()); !errors.Is(err, os.ErrNotExist) {
+		require.NoError(t, err)
+	}
 	if _, err := os.Stat(s.store.Name()); !errors.Is(err, os.ErrNotExist) {
 		require.NoError(t, err)
 	}
@@ -2,25 +2,69 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	encoding = binary.BigEndian
+
+	// crcTable is the CRC-32C (Castagnoli) table used to checksum records.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptRecord = errors.New("corrupt record: checksum mismatch")
+	errCorruptStore  = errors.New("corrupt store: intact records follow a corrupt one")
+
+	errUnknownStoreFormat = errors.New("unknown store format")
+
+	// storeFormat is the header every store starts with: a magic number along
+	// with the version of the format, i.e. records framed with a checksum.
+	storeFormat = []byte{'P', 'L', 'O', 'G', 0, 0, 0, 1}
 )
 
 const (
 	lenWidth = 8
+	crcWidth = 4
+
+	// Every record is framed by a header holding its length and checksum.
+	headerWidth = lenWidth + crcWidth
+
+	// formatWidth is the width of the header at the start of the store, see
+	// storeFormat.
+	formatWidth = 8
+
+	// The most significant byte of the length prefix holds the codec the
+	// record is compressed with, the remaining bits hold the actual length.
+	codecShift        = 56
+	lenMask    uint64 = 1<<codecShift - 1
+
+	// frameChunkBytes is the most readFrame allocates up front for the data of
+	// a record, as its length can't be trusted yet.
+	frameChunkBytes = 64 * 1024
 )
 
 // A wrapper around physical files to store records in
 type store struct {
+	// flushed is the number of bytes written to the file, i.e. that can be
+	// read without flushing the buffer first. It is accessed atomically.
+	flushed uint64
+
 	*os.File
 	buf  *bufio.Writer
 	size uint64
 	mu   sync.Mutex
+
+	// refs is the number of readers pinning the store, see pin. A store closed
+	// while pinned only closes its file once the last of them is done.
+	refs    int
+	closing bool
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -30,86 +74,363 @@ func newStore(f *os.File) (*store, error) {
 	}
 
 	size := uint64(file.Size())
-	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+	s := &store{
+		File:    f,
+		size:    size,
+		flushed: size,
+		buf:     bufio.NewWriter(f),
+	}
+	if err = s.checkFormat(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-// Append persists the given bytes to the store. It returns the number of bytes
-// written, the position where the store holds the record in its file, and error
-// if any.
-func (s *store) Append(b []byte) (n uint64, pos uint64, err error) {
+// checkFormat writes the format header of a new store, and checks the one of an
+// existing store. A store without the header, e.g. one written before records
+// got checksums, is refused rather than taken for a torn write and truncated.
+func (s *store) checkFormat() error {
+	if s.size >= formatWidth {
+		header := make([]byte, formatWidth)
+		if _, err := s.File.ReadAt(header, 0); err != nil {
+			return err
+		}
+		if !bytes.Equal(header, storeFormat) {
+			return fmt.Errorf("%w: %s", errUnknownStoreFormat, s.Name())
+		}
+		return nil
+	}
+
+	// Only a store created right before a crash can be shorter than its
+	// header, in which case it holds part of the header at most
+	header := make([]byte, s.size)
+	if _, err := s.File.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(storeFormat, header) {
+		return fmt.Errorf("%w: %s", errUnknownStoreFormat, s.Name())
+	}
+	if err := s.File.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := s.File.Write(storeFormat); err != nil {
+		return err
+	}
+	s.size = formatWidth
+	s.flushed = formatWidth
+	return nil
+}
+
+// Append persists the given bytes, compressed with the given codec, to the
+// store. It returns the number of bytes written, the position where the store
+// holds the record in its file, and error if any.
+func (s *store) Append(b []byte, codec Codec) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	pos = s.size
 
 	// Write the length of the record so that when reading the record, we know
-	// how many bytes to read
-	if err := binary.Write(s.buf, encoding, uint64(len(b))); err != nil {
+	// how many bytes to read, followed by the checksum of the record
+	header := make([]byte, headerWidth)
+	putLength(header, uint64(len(b)), codec)
+	encoding.PutUint32(header[lenWidth:], checksum(header[:lenWidth], b))
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
 
 	// Write the record data
 	numBytesWritten, err := s.buf.Write(b)
 	if err != nil {
-		return 0, 0, nil
+		return 0, 0, err
 	}
 
-	numBytesWritten += lenWidth
+	numBytesWritten += headerWidth
 	s.size += uint64(numBytesWritten)
 	return uint64(numBytesWritten), pos, nil
 }
 
-// Read returns the record stored at a given position and the error, if any
-func (s *store) Read(pos uint64) ([]byte, error) {
+// Flush writes any buffered data to the underlying file.
+func (s *store) Flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.flush()
+}
 
-	// Make sure we flush all data in the buffer before reading the file
+// flush writes any buffered data to the underlying file. It must be called with
+// the lock held.
+func (s *store) flush() error {
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return err
 	}
+	atomic.StoreUint64(&s.flushed, s.size)
+	return nil
+}
+
+// Sync writes any buffered data to the underlying file and commits the file's
+// content to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Size returns the number of bytes appended to the store so far.
+func (s *store) Size() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
 
+// Read returns the record stored at a given position, the codec it is
+// compressed with and the error, if any
+func (s *store) Read(pos uint64) ([]byte, Codec, error) {
 	// Find out how many bytes we need in order to fetch the record
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	header := make([]byte, headerWidth)
+	if _, err := s.ReadAt(header, int64(pos)); err != nil {
+		return nil, 0, err
 	}
 
-	// Retrieve the record data as bytes
-	b := make([]byte, encoding.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	// Retrieve the record data as bytes, once the length has been checked
+	// against the size of the store so that a corrupt one isn't allocated. The
+	// lock is only taken when the record isn't all written to the file yet.
+	n, codec := parseLength(header)
+	end := pos + headerWidth + n
+	if end > atomic.LoadUint64(&s.flushed) && end > s.Size() {
+		return nil, 0, errCorruptRecord
+	}
+	b := make([]byte, n)
+	if _, err := s.ReadAt(b, int64(pos+headerWidth)); err != nil {
+		return nil, 0, err
+	}
+
+	if encoding.Uint32(header[lenWidth:]) != checksum(header[:lenWidth], b) {
+		return nil, 0, errCorruptRecord
 	}
 
-	return b, nil
+	return b, codec, nil
 }
 
 // ReadAt reads len(b) bytes starting at the offset off from the store's file.
 // It returns the number of bytes read and the error, if any.
+//
+// The lock is only taken to flush the buffer when the requested bytes haven't
+// been written to the file yet. Reads of data already in the file, which is
+// always the case for sealed segments, don't contend with appends at all.
 func (s *store) ReadAt(b []byte, off int64) (int, error) {
+	if uint64(off)+uint64(len(b)) > atomic.LoadUint64(&s.flushed) {
+		s.mu.Lock()
+		err := s.flush()
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return s.File.ReadAt(b, off)
+}
+
+// Repair walks the store from the beginning and truncates the file right after
+// the last record whose frame is complete and whose checksum matches. This
+// gets rid of a half-written record left behind by an ungraceful shutdown. It
+// returns the positions of the intact records along with the number of bytes
+// discarded.
+//
+// Only a torn tail is discarded, i.e. when no intact frame follows the bad one.
+// Anything else means the store got corrupted in the middle, which Repair
+// reports with errCorruptStore rather than throwing away the records after it.
+func (s *store) Repair() (positions []uint64, discarded uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Flush any buffered data before the read
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	if err := s.flush(); err != nil {
+		return nil, 0, err
 	}
 
-	return s.File.ReadAt(b, off)
+	// The format has been checked already, the records come after it
+	pos := uint64(formatWidth)
+	for pos+headerWidth <= s.size {
+		n, ok, err := s.frameAt(pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			break
+		}
+		positions = append(positions, pos)
+		pos += headerWidth + n
+	}
+
+	if pos == s.size {
+		return positions, 0, nil
+	}
+
+	// The bad frame may have a corrupt length, so any position after it may
+	// be where the next intact frame starts
+	for next := pos + 1; next+headerWidth <= s.size; next++ {
+		_, ok, err := s.frameAt(next)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			return nil, 0, fmt.Errorf(
+				"%w: %s at position %d, intact record at position %d",
+				errCorruptStore,
+				s.Name(),
+				pos,
+				next,
+			)
+		}
+	}
+
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	discarded = s.size - pos
+	s.size = pos
+	atomic.StoreUint64(&s.flushed, pos)
+	return positions, discarded, nil
 }
 
-// Close closes the file and also persists any buffered data before doing so
+// frameAt reports whether an intact record frame, i.e. complete and whose
+// checksum matches, starts at the given position, along with the length of its
+// record. It must be called with the lock held and the buffer flushed.
+func (s *store) frameAt(pos uint64) (n uint64, ok bool, err error) {
+	header := make([]byte, headerWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return 0, false, err
+	}
+
+	n, _ = parseLength(header)
+	if n > s.size-pos-headerWidth {
+		return 0, false, nil
+	}
+
+	b := make([]byte, n)
+	if _, err := s.File.ReadAt(b, int64(pos+headerWidth)); err != nil {
+		return 0, false, err
+	}
+	if encoding.Uint32(header[lenWidth:]) != checksum(header[:lenWidth], b) {
+		return 0, false, nil
+	}
+	return n, true, nil
+}
+
+// Truncate drops the data stored from the given position onwards.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	atomic.StoreUint64(&s.flushed, size)
+	return nil
+}
+
+// Close closes the file and also persists any buffered data before doing so.
+// The file of a pinned store is closed once the store is no longer pinned.
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	err := s.buf.Flush()
+	err := s.flush()
 	if err != nil {
 		return err
 	}
+	if s.refs > 0 {
+		s.closing = true
+		return nil
+	}
 	return s.File.Close()
 }
+
+// pin keeps the file of the store open until unpin is called, even if the store
+// is closed in the meantime, e.g. because its segment got removed or compacted.
+// The content of the file stays readable after it has been removed or replaced
+// by a compacted one, so readers of the store aren't cut off halfway through.
+func (s *store) pin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs++
+}
+
+// unpin releases the store pinned by pin, and closes its file if the store got
+// closed in the meantime.
+func (s *store) unpin() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refs--
+	if s.refs > 0 || !s.closing {
+		return nil
+	}
+	return s.File.Close()
+}
+
+// readFrame reads a whole record frame from r and returns the record's data
+// along with the codec it is compressed with. It returns io.EOF if r has no
+// more data, or io.ErrUnexpectedEOF if the frame is incomplete.
+func readFrame(r io.Reader) ([]byte, Codec, error) {
+	header := make([]byte, headerWidth)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+
+	// The length can't be trusted until the checksum has been verified, so the
+	// data is buffered as it comes instead of allocating the whole length up
+	// front. A corrupt length can't take more memory than r actually holds.
+	n, codec := parseLength(header)
+	buf := bytes.NewBuffer(make([]byte, 0, minUint64(n, frameChunkBytes)))
+	if _, err := io.CopyN(buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	b := buf.Bytes()
+
+	if encoding.Uint32(header[lenWidth:]) != checksum(header[:lenWidth], b) {
+		return nil, 0, errCorruptRecord
+	}
+	return b, codec, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// putLength writes the length prefix of a record frame to the given header.
+func putLength(header []byte, n uint64, codec Codec) {
+	encoding.PutUint64(header[:lenWidth], uint64(codec)<<codecShift|n&lenMask)
+}
+
+// parseLength returns the length of the record and its codec from the given
+// frame header.
+func parseLength(header []byte) (n uint64, codec Codec) {
+	v := encoding.Uint64(header[:lenWidth])
+	return v & lenMask, Codec(v >> codecShift)
+}
+
+// checksum computes the CRC of a record frame, covering both its length prefix
+// and its data so that a zeroed-out region never passes as a valid record.
+func checksum(length, b []byte) uint32 {
+	h := crc32.New(crcTable)
+	h.Write(length)
+	h.Write(b)
+	return h.Sum32()
+}
@@ -1,7 +1,10 @@
 package log
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -9,7 +12,7 @@ import (
 
 var (
 	recordData  = []byte("hellow world")
-	recordWidth = uint64(len(recordData)) + lenWidth
+	recordWidth = uint64(len(recordData)) + headerWidth
 )
 
 func TestAppend(t *testing.T) {
@@ -45,37 +48,38 @@ func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	// write 4 records with the same data to the store
 	for i := uint64(1); i < 4; i++ {
-		n, pos, err := s.Append(recordData)
+		n, pos, err := s.Append(recordData, CodecNone)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, recordWidth*i)
+		require.Equal(t, pos+n, formatWidth+recordWidth*i)
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := uint64(formatWidth)
 	for i := uint64(1); i < 4; i++ {
-		got, err := s.Read(pos)
+		got, codec, err := s.Read(pos)
 		require.NoError(t, err)
 		require.Equal(t, recordData, got)
+		require.Equal(t, CodecNone, codec)
 		pos += recordWidth
 	}
 }
 
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
-	for i, off := uint64(1), int64(0); i < 4; i++ {
-		// Read the length of the record
-		b := make([]byte, lenWidth)
+	for i, off := uint64(1), int64(formatWidth); i < 4; i++ {
+		// Read the length and checksum of the record
+		b := make([]byte, headerWidth)
 		n, err := s.ReadAt(b, off)
 
 		require.NoError(t, err)
-		require.Equal(t, int(lenWidth), n)
+		require.Equal(t, int(headerWidth), n)
 
 		off += int64(n)
 
 		// Read the record itself
-		size := encoding.Uint64(b)
+		size := encoding.Uint64(b[:lenWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 
@@ -87,6 +91,213 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestRepair(t *testing.T) {
+	for scenario, tt := range map[string]struct {
+		corrupt func(t *testing.T, f *os.File)
+		// number of intact records left after the repair
+		records uint64
+	}{
+		"torn header": {
+			corrupt: func(t *testing.T, f *os.File) {
+				_, err := f.WriteAt([]byte{0, 0, 0}, int64(formatWidth+recordWidth*3))
+				require.NoError(t, err)
+			},
+			records: 3,
+		},
+		"zeroed tail": {
+			corrupt: func(t *testing.T, f *os.File) {
+				_, err := f.WriteAt(make([]byte, recordWidth), int64(formatWidth+recordWidth*3))
+				require.NoError(t, err)
+			},
+			records: 3,
+		},
+		"torn record": {
+			corrupt: func(t *testing.T, f *os.File) {
+				err := f.Truncate(int64(formatWidth+recordWidth*3) - 2)
+				require.NoError(t, err)
+			},
+			records: 2,
+		},
+		"corrupt record": {
+			corrupt: func(t *testing.T, f *os.File) {
+				_, err := f.WriteAt([]byte("x"), int64(formatWidth+recordWidth*3)-1)
+				require.NoError(t, err)
+			},
+			records: 2,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := os.CreateTemp("", "store_repair_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			s, err := newStore(f)
+			require.NoError(t, err)
+			testAppend(t, s)
+			require.NoError(t, s.Close())
+
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+			require.NoError(t, err)
+			tt.corrupt(t, f)
+			require.NoError(t, f.Close())
+
+			f, size, err := openFile(f.Name())
+			require.NoError(t, err)
+			s, err = newStore(f)
+			require.NoError(t, err)
+
+			positions, discarded, err := s.Repair()
+			require.NoError(t, err)
+			require.Len(t, positions, int(tt.records))
+			want := formatWidth + recordWidth*tt.records
+			require.Equal(t, want, s.size)
+			require.Equal(t, uint64(size)-want, discarded)
+
+			fi, err := os.Stat(f.Name())
+			require.NoError(t, err)
+			require.Equal(t, int64(want), fi.Size())
+
+			// New records are appended right after the last intact one
+			_, pos, err := s.Append(recordData, CodecNone)
+			require.NoError(t, err)
+			require.Equal(t, want, pos)
+			got, _, err := s.Read(pos)
+			require.NoError(t, err)
+			require.Equal(t, recordData, got)
+		})
+	}
+}
+
+func TestRepairCorruptMiddle(t *testing.T) {
+	for scenario, corrupt := range map[string]func(t *testing.T, f *os.File){
+		"corrupt record": func(t *testing.T, f *os.File) {
+			_, err := f.WriteAt([]byte("x"), int64(formatWidth+recordWidth*2)-1)
+			require.NoError(t, err)
+		},
+		"corrupt length": func(t *testing.T, f *os.File) {
+			_, err := f.WriteAt([]byte{0xff}, int64(formatWidth+recordWidth)+lenWidth-1)
+			require.NoError(t, err)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := os.CreateTemp("", "store_repair_middle_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			s, err := newStore(f)
+			require.NoError(t, err)
+			testAppend(t, s)
+			require.NoError(t, s.Close())
+
+			f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+			require.NoError(t, err)
+			corrupt(t, f)
+			require.NoError(t, f.Close())
+
+			f, size, err := openFile(f.Name())
+			require.NoError(t, err)
+			s, err = newStore(f)
+			require.NoError(t, err)
+
+			// The intact record after the corrupt one isn't thrown away
+			_, _, err = s.Repair()
+			require.ErrorIs(t, err, errCorruptStore)
+			fi, err := os.Stat(f.Name())
+			require.NoError(t, err)
+			require.Equal(t, size, fi.Size())
+		})
+	}
+}
+
+func TestReadCorruptRecord(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_corrupt_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), int64(formatWidth+headerWidth))
+	require.NoError(t, err)
+
+	s, err = newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Read(formatWidth)
+	require.Equal(t, errCorruptRecord, err)
+}
+
+func TestReadCorruptLength(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_corrupt_length_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	// A length way past the end of the store, right below the codec byte
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x7f}, formatWidth+1)
+	require.NoError(t, err)
+
+	s, err = newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Read(formatWidth)
+	require.Equal(t, errCorruptRecord, err)
+
+	// Streams don't allocate more than the data they actually hold either
+	b, err := io.ReadAll(io.NewSectionReader(f, formatWidth, int64(s.Size())-formatWidth))
+	require.NoError(t, err)
+	_, _, err = readFrame(bytes.NewReader(b))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestOpenBaselineFormat(t *testing.T) {
+	dir, err := os.MkdirTemp("", "store_baseline_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Records were only framed by their length before checksums came along
+	var baseline []byte
+	for i := 0; i < 5; i++ {
+		frame := make([]byte, lenWidth)
+		encoding.PutUint64(frame, uint64(len(recordData)))
+		baseline = append(baseline, append(frame, recordData...)...)
+	}
+	name := path.Join(dir, "0.store")
+	require.NoError(t, os.WriteFile(name, baseline, 0644))
+
+	// The log isn't opened rather than taking the records for a torn write
+	_, err = NewLog(dir, Config{})
+	require.ErrorIs(t, err, errUnknownStoreFormat)
+	got, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, baseline, got)
+}
+
+func TestOpenTornFormat(t *testing.T) {
+	f, err := os.CreateTemp("", "store_torn_format_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// The store was created right before a crash
+	_, err = f.Write(storeFormat[:3])
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, uint64(formatWidth), s.Size())
+	testAppend(t, s)
+	testRead(t, s)
+	require.NoError(t, s.Close())
+}
+
 func TestClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
@@ -95,7 +306,7 @@ func TestClose(t *testing.T) {
 	s, err := newStore(f)
 	require.NoError(t, err)
 
-	_, _, err = s.Append(recordData)
+	_, _, err = s.Append(recordData, CodecNone)
 	require.NoError(t, err)
 
 	f, beforeCloseSize, err := openFile(f.Name())
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+// Topic is a named stream of records split into partitions, each of them being
+// a log stored in the Dir/<partition> directory. Records are only ordered
+// within a partition: the records appended to a partition are read back in the
+// order they were appended, but there is no order across partitions.
+type Topic struct {
+	Name string
+	Dir  string
+
+	partitions []*Log
+
+	// next is the partition the next record without a key goes to. It is
+	// accessed atomically.
+	next uint32
+}
+
+// newTopic creates a topic with the given number of partitions in the given
+// directory, or opens it if it already exists. The number of partitions of an
+// existing topic is the one it was created with.
+func newTopic(name, dir string, partitions uint32, c Config) (*Topic, error) {
+	t := &Topic{Name: name, Dir: dir}
+
+	if n, err := countPartitions(dir); err != nil {
+		return nil, err
+	} else if n > 0 {
+		partitions = n
+	}
+	if partitions == 0 {
+		partitions = 1
+	}
+
+	for i := uint32(0); i < partitions; i++ {
+		dir := path.Join(t.Dir, strconv.FormatUint(uint64(i), 10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Close()
+			return nil, err
+		}
+		l, err := NewLog(dir, c)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.partitions = append(t.partitions, l)
+	}
+	return t, nil
+}
+
+// countPartitions returns the number of partitions stored in the given topic
+// directory, which are expected to be numbered from 0.
+func countPartitions(dir string) (uint32, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[uint64]bool)
+	for _, file := range files {
+		n, err := strconv.ParseUint(file.Name(), 10, 32)
+		if err == nil && file.IsDir() {
+			seen[n] = true
+		}
+	}
+	for n := range seen {
+		if n >= uint64(len(seen)) {
+			return 0, fmt.Errorf("missing partitions in topic directory %s", dir)
+		}
+	}
+	return uint32(len(seen)), nil
+}
+
+// Partitions returns the number of partitions of the topic.
+func (t *Topic) Partitions() uint32 {
+	return uint32(len(t.partitions))
+}
+
+// Partition returns the log of the given partition, or ErrPartitionNotFound if
+// the topic has no such partition.
+func (t *Topic) Partition(n uint32) (*Log, error) {
+	if n >= t.Partitions() {
+		return nil, api.ErrPartitionNotFound{Topic: t.Name, Partition: n}
+	}
+	return t.partitions[n], nil
+}
+
+// PartitionFor picks the partition to append the given record to. Records with
+// a key always go to the same partition, based on a hash of their key, so that
+// they keep their order. Records without a key are spread over the partitions
+// in a round-robin fashion.
+func (t *Topic) PartitionFor(record *api.Record) uint32 {
+	if len(record.GetKey()) == 0 {
+		return (atomic.AddUint32(&t.next, 1) - 1) % t.Partitions()
+	}
+	h := fnv.New32a()
+	h.Write(record.Key)
+	return h.Sum32() % t.Partitions()
+}
+
+// Close closes the logs of all partitions.
+func (t *Topic) Close() error {
+	for _, l := range t.partitions {
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
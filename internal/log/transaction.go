@@ -0,0 +1,264 @@
+package log
+
+import (
+	"sync/atomic"
+	"time"
+
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// transaction is a transaction that is open in the log.
+type transaction struct {
+	// begin is the offset of the transaction's BEGIN control record
+	begin uint64
+	// began is when the transaction began
+	began time.Time
+}
+
+// BeginTransaction opens a new transaction by appending its BEGIN control
+// record, and returns its ID. Records are then appended to the transaction by
+// setting their transaction ID, until it is either committed or aborted.
+func (l *Log) BeginTransaction() (uint64, error) {
+	return l.beginTransaction(0)
+}
+
+// beginTransaction opens a new transaction, see BeginTransaction, whose BEGIN
+// control record gets the given timestamp, or the current time when zero.
+func (l *Log) beginTransaction(ts int64) (uint64, error) {
+	id := atomic.AddUint64(&l.lastTxnID, 1)
+	_, err := l.append(&api.Record{
+		TransactionId: id,
+		Control:       api.ControlType_BEGIN,
+		Timestamp:     ts,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// CommitTransaction ends the given transaction by appending its COMMIT control
+// record, which makes its records visible to read-committed consumers.
+func (l *Log) CommitTransaction(id uint64) error {
+	return l.endTransaction(id, api.ControlType_COMMIT, 0)
+}
+
+// AbortTransaction ends the given transaction by appending its ABORT control
+// record, which hides its records from read-committed consumers for good.
+func (l *Log) AbortTransaction(id uint64) error {
+	return l.endTransaction(id, api.ControlType_ABORT, 0)
+}
+
+// endTransaction ends the given transaction with the given control record,
+// which gets the given timestamp, or the current time when zero.
+func (l *Log) endTransaction(id uint64, control api.ControlType, ts int64) error {
+	_, err := l.append(&api.Record{
+		TransactionId: id,
+		Control:       control,
+		Timestamp:     ts,
+	})
+	return err
+}
+
+// checkTransaction checks that the given record can be appended as far as
+// transactions are concerned, i.e. that the transaction it is part of is open.
+// It must be called with the active segment write-locked.
+func (l *Log) checkTransaction(record *api.Record) error {
+	if record.TransactionId == 0 {
+		if record.Control != api.ControlType_NONE {
+			return errControlRecord
+		}
+		return nil
+	}
+	if record.Control == api.ControlType_BEGIN {
+		return nil
+	}
+
+	l.txnMu.RLock()
+	_, ok := l.openTxns[record.TransactionId]
+	l.txnMu.RUnlock()
+	if !ok {
+		return api.ErrTransactionNotFound{TransactionID: record.TransactionId}
+	}
+	return nil
+}
+
+// trackTransaction updates the state of the transactions after the given
+// record has been appended at the given offset. It must be called with the
+// active segment write-locked, or while setting up the log.
+func (l *Log) trackTransaction(record *api.Record, off uint64) {
+	id := record.TransactionId
+	// Any record of a transaction raises the last ID, not only BEGIN records:
+	// retention may have removed the BEGIN record of a transaction whose
+	// ABORT record is still around, and its ID must not be reused
+	if id > atomic.LoadUint64(&l.lastTxnID) {
+		atomic.StoreUint64(&l.lastTxnID, id)
+	}
+	if record.Control == api.ControlType_NONE {
+		return
+	}
+
+	l.txnMu.Lock()
+	defer l.txnMu.Unlock()
+	switch record.Control {
+	case api.ControlType_BEGIN:
+		l.openTxns[id] = transaction{
+			begin: off,
+			began: time.UnixMilli(record.Timestamp),
+		}
+	case api.ControlType_COMMIT:
+		delete(l.openTxns, id)
+	case api.ControlType_ABORT:
+		delete(l.openTxns, id)
+		l.abortedTxns[id] = off
+	}
+}
+
+// resetTransactions forgets about all transactions.
+func (l *Log) resetTransactions() {
+	l.txnMu.Lock()
+	defer l.txnMu.Unlock()
+	l.openTxns = make(map[uint64]transaction)
+	l.abortedTxns = make(map[uint64]uint64)
+}
+
+// forgetAbortedTransactions forgets about the aborted transactions which ended
+// before the given offset, as none of their records are left in the log.
+func (l *Log) forgetAbortedTransactions(lowest uint64) {
+	l.txnMu.Lock()
+	defer l.txnMu.Unlock()
+	for id, off := range l.abortedTxns {
+		if off < lowest {
+			delete(l.abortedTxns, id)
+		}
+	}
+}
+
+// stableOffset returns the offset up to which every record is either outside of
+// a transaction or part of a transaction that has ended, i.e. the offset of the
+// first open transaction's BEGIN record, or the next offset if there is none.
+func (l *Log) stableOffset() uint64 {
+	l.mu.RLock()
+	s := l.activeSegment
+	l.mu.RUnlock()
+
+	// Hold the active segment's lock so that a transaction can't begin between
+	// reading the next offset and looking at the open transactions
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stable := s.nextOffset
+
+	l.txnMu.RLock()
+	defer l.txnMu.RUnlock()
+	for _, txn := range l.openTxns {
+		if txn.begin < stable {
+			stable = txn.begin
+		}
+	}
+	return stable
+}
+
+// ReadCommitted reads the record stored at the given offset on behalf of a
+// read-committed consumer. It returns ErrOffsetOutOfRange for offsets past the
+// first open transaction, as whether their records are visible isn't known yet,
+// and ErrRecordNotVisible for control records and records of aborted
+// transactions.
+func (l *Log) ReadCommitted(off uint64) (*api.Record, error) {
+	if off >= l.stableOffset() {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+
+	record, err := l.Read(off)
+	if err != nil {
+		return nil, err
+	}
+	if record.Control != api.ControlType_NONE {
+		return nil, api.ErrRecordNotVisible{Offset: off}
+	}
+	if l.isAborted(record.TransactionId) {
+		return nil, api.ErrRecordNotVisible{Offset: off}
+	}
+	return record, nil
+}
+
+// isAborted reports whether the given transaction has been aborted. Records
+// outside of a transaction, i.e. with a zero ID, are never aborted.
+func (l *Log) isAborted(id uint64) bool {
+	if id == 0 {
+		return false
+	}
+	l.txnMu.RLock()
+	defer l.txnMu.RUnlock()
+	_, aborted := l.abortedTxns[id]
+	return aborted
+}
+
+// WatchCommitted returns a channel that is closed once the record at the given
+// offset can be read by read-committed consumers, see Watch.
+func (l *Log) WatchCommitted(off uint64) <-chan struct{} {
+	l.notifyMu.Lock()
+	ch := l.appended
+	l.notifyMu.Unlock()
+
+	if off < l.stableOffset() {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return ch
+}
+
+// runTransactionTimeouts periodically aborts the transactions that have been
+// open for longer than the transaction timeout, until the log is closed. This
+// keeps read-committed consumers from waiting forever for a transaction whose
+// producer went away, including after a restart.
+func (l *Log) runTransactionTimeouts() {
+	defer l.wg.Done()
+
+	timeout := l.Config.Transactions.Timeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			for _, id := range l.expiredTransactions(timeout) {
+				err := l.AbortTransaction(id)
+				if _, ended := err.(api.ErrTransactionNotFound); ended {
+					continue
+				}
+				if err != nil {
+					zap.L().Named("log").Error(
+						"failed to abort timed out transaction",
+						zap.String("dir", l.Dir),
+						zap.Uint64("transaction_id", id),
+						zap.Error(err),
+					)
+					continue
+				}
+				zap.L().Named("log").Warn(
+					"aborted timed out transaction",
+					zap.String("dir", l.Dir),
+					zap.Uint64("transaction_id", id),
+				)
+			}
+		}
+	}
+}
+
+// expiredTransactions returns the IDs of the transactions which have been open
+// for longer than the given timeout.
+func (l *Log) expiredTransactions(timeout time.Duration) []uint64 {
+	l.txnMu.RLock()
+	defer l.txnMu.RUnlock()
+
+	var expired []uint64
+	for id, txn := range l.openTxns {
+		if time.Since(txn.began) > timeout {
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
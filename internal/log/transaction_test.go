@@ -0,0 +1,171 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	api "github.com/tkhoa2711/proglog/api/v1"
+)
+
+func transactionRecord(id uint64, value string) *api.Record {
+	return &api.Record{
+		Value:         []byte(value),
+		TransactionId: id,
+	}
+}
+
+// requireVisible checks which offsets of the log read-committed consumers see.
+func requireVisible(t *testing.T, log *Log, upTo uint64, visible ...uint64) {
+	t.Helper()
+	isVisible := make(map[uint64]bool)
+	for _, off := range visible {
+		isVisible[off] = true
+	}
+	for off := uint64(0); off < upTo; off++ {
+		record, err := log.ReadCommitted(off)
+		if !isVisible[off] {
+			require.Equal(t, api.ErrRecordNotVisible{Offset: off}, err, "offset %d", off)
+			continue
+		}
+		require.NoError(t, err, "offset %d", off)
+		require.Equal(t, off, record.Offset)
+	}
+}
+
+func TestLogTransactions(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+
+	first, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(transactionRecord(first, "first"))
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("outside")})
+	require.NoError(t, err)
+
+	// Nothing past the open transaction is visible yet
+	_, err = log.ReadCommitted(2)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("outside"), record.Value)
+	watch := log.WatchCommitted(2)
+	require.False(t, isClosed(watch))
+
+	second, err := log.BeginTransaction()
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	_, err = log.AppendBatch([]*api.Record{transactionRecord(second, "second")})
+	require.NoError(t, err)
+
+	require.NoError(t, log.CommitTransaction(first))
+	require.True(t, isClosed(watch))
+	require.NoError(t, log.AbortTransaction(second))
+	_, err = log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+
+	// Control records and aborted records are hidden
+	requireVisible(t, log, 8, 1, 2, 7)
+	for off := uint64(0); off < 8; off++ {
+		_, err = log.Read(off)
+		require.NoError(t, err)
+	}
+
+	// Ended transactions can't be appended to, nor ended again
+	_, err = log.Append(transactionRecord(first, "late"))
+	require.Equal(t, api.ErrTransactionNotFound{TransactionID: first}, err)
+	require.Equal(
+		t,
+		api.ErrTransactionNotFound{TransactionID: second},
+		log.CommitTransaction(second),
+	)
+
+	// Only the log appends control records
+	_, err = log.Append(&api.Record{Control: api.ControlType_COMMIT})
+	require.Equal(t, errControlRecord, err)
+	_, err = log.AppendBatch([]*api.Record{{Control: api.ControlType_BEGIN, TransactionId: 42}})
+	require.Equal(t, errControlRecord, err)
+}
+
+func TestLogTransactionsRecovery(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+
+	aborted, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(transactionRecord(aborted, "aborted"))
+	require.NoError(t, err)
+	require.NoError(t, log.AbortTransaction(aborted))
+
+	open, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(transactionRecord(open, "open"))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// The open transaction is still open after a restart, and the aborted
+	// one still hidden
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.ReadCommitted(4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+
+	_, err = log.Append(transactionRecord(open, "resumed"))
+	require.NoError(t, err)
+	require.NoError(t, log.CommitTransaction(open))
+	requireVisible(t, log, 7, 4, 5)
+
+	// Transaction IDs aren't reused
+	id, err := log.BeginTransaction()
+	require.NoError(t, err)
+	require.Greater(t, id, open)
+
+	// Not even once retention has removed the BEGIN record of an aborted
+	// transaction whose ABORT record is left
+	_, err = log.Append(transactionRecord(id, "aborted"))
+	require.NoError(t, err)
+	require.NoError(t, log.AbortTransaction(id))
+	require.NoError(t, log.Truncate(9))
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	next, err := log.BeginTransaction()
+	require.NoError(t, err)
+	require.Greater(t, next, id)
+	off, err := log.Append(transactionRecord(next, "committed"))
+	require.NoError(t, err)
+	require.NoError(t, log.CommitTransaction(next))
+	record, err := log.ReadCommitted(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("committed"), record.Value)
+}
+
+func TestLogTransactionTimeout(t *testing.T) {
+	c := Config{}
+	c.Transactions.Timeout = 50 * time.Millisecond
+	log := newTestLog(t, c)
+	defer os.RemoveAll(log.Dir)
+	defer log.Close()
+
+	id, err := log.BeginTransaction()
+	require.NoError(t, err)
+	_, err = log.Append(transactionRecord(id, "abandoned"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := log.ReadCommitted(1)
+		return err == api.ErrRecordNotVisible{Offset: 1}
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = log.Append(transactionRecord(id, "too late"))
+	require.Equal(t, api.ErrTransactionNotFound{TransactionID: id}, err)
+}
@@ -2,6 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"sort"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
@@ -9,6 +12,8 @@ import (
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	api "github.com/tkhoa2711/proglog/api/v1"
+	"github.com/tkhoa2711/proglog/internal/group"
+	"github.com/tkhoa2711/proglog/internal/log"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
@@ -19,13 +24,19 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+// defaultFetchMaxBytes caps the size of the records returned by Fetch when the
+// request doesn't, well below gRPC's default maximum message size.
+const defaultFetchMaxBytes = 1 << 20
+
 const (
 	// ACL policy related constants
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
 )
 
 type subjectContextKey struct{}
@@ -36,12 +47,110 @@ type Authorizer interface {
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
 	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+	Watch(uint64) <-chan struct{}
+	OffsetForTimestamp(time.Time) (uint64, error)
+
+	// Transactions and reads on behalf of read-committed consumers
+	BeginTransaction() (uint64, error)
+	CommitTransaction(uint64) error
+	AbortTransaction(uint64) error
+	ReadCommitted(uint64) (*api.Record, error)
+	WatchCommitted(uint64) <-chan struct{}
+}
+
+// TopicManager gives access to the topics.
+type TopicManager interface {
+	// Topic returns the given topic, or ErrTopicNotFound.
+	Topic(name string) (Topic, error)
+	// CreateTopic creates the given topic with the given number of partitions
+	// if it doesn't exist yet, and returns it.
+	CreateTopic(name string, partitions uint32) (Topic, error)
+	// Topics returns the names of all topics.
+	Topics() []string
+}
+
+// Topic is a stream of records split into partitions, each of them being a
+// commit log. Records are only ordered within a partition.
+type Topic interface {
+	Partitions() uint32
+	// Partition returns the commit log of the given partition, or
+	// ErrPartitionNotFound.
+	Partition(n uint32) (CommitLog, error)
+	// PartitionFor picks the partition to append the given record to when the
+	// producer doesn't pick one.
+	PartitionFor(*api.Record) uint32
+}
+
+// OffsetStore keeps track of the offsets committed by consumer groups.
+type OffsetStore interface {
+	Commit(group, topic string, partition uint32, offset uint64) error
+	// Fetch returns the offset last committed, or ErrNoCommittedOffset.
+	Fetch(group, topic string, partition uint32) (uint64, error)
+}
+
+// GroupCoordinator keeps track of the members of the consumer groups and
+// assigns them partitions.
+type GroupCoordinator interface {
+	// Join adds a member to the group, subscribed to the given topics along
+	// with their number of partitions, and returns its assignment.
+	Join(
+		name, memberID string,
+		topics map[string]uint32,
+		strategy api.AssignmentStrategy,
+	) (group.Member, error)
+	Heartbeat(name, memberID string, generation uint64) error
+	Leave(name, memberID string) error
+	// CheckGeneration returns an error unless the member may commit offsets
+	// on behalf of the given generation of the group.
+	CheckGeneration(name, memberID string, generation uint64) error
+}
+
+// WorkQueue delivers the records of a commit log as a work queue.
+type WorkQueue interface {
+	// Lease delivers the next record, or returns ErrOffsetOutOfRange if there
+	// is none.
+	Lease() (*log.Delivery, error)
+	// Ack and Nack end the lease of the given delivery of the record, and
+	// return an error if the record has been delivered again since.
+	Ack(offset uint64, deliveries uint32) error
+	Nack(offset uint64, deliveries uint32) error
+	// Watch returns a channel that is closed once there may be a record to
+	// lease, or once done is closed.
+	Watch(done <-chan struct{}) <-chan struct{}
+}
+
+// ServerGetter lists the servers of the cluster.
+type ServerGetter interface {
+	GetServers() ([]*api.Server, error)
 }
 
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	// CommitLog serves the requests which don't name a topic.
+	CommitLog CommitLog
+	// Topics serves the requests which name a topic. When nil, only the
+	// requests without a topic are served.
+	Topics TopicManager
+	// AutoCreateTopics makes producing to a topic that doesn't exist create
+	// it rather than fail with ErrTopicNotFound.
+	AutoCreateTopics bool
+	// Offsets stores the offsets committed by consumer groups. When nil,
+	// consumer groups are not supported.
+	Offsets OffsetStore
+	// Groups coordinates the members of the consumer groups. When nil, the
+	// consumers of a group have to share out the partitions by themselves.
+	Groups GroupCoordinator
+	// Queue delivers the records of the default commit log as a work queue.
+	// When nil, the queue RPCs are not supported.
+	Queue WorkQueue
+	// ServerGetter lists the servers of the cluster for clients to discover
+	// them. When nil, GetServers is not supported.
+	ServerGetter ServerGetter
+	Authorizer   Authorizer
 }
 
 type grpcServer struct {
@@ -106,11 +215,111 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 		return nil, err
 	}
 
-	off, err := s.CommitLog.Append(req.Record)
+	topic, err := s.topic(req.Topic, s.AutoCreateTopics)
+	if err != nil {
+		return nil, err
+	}
+	partition := topic.PartitionFor(req.Record)
+	if req.Partition != nil {
+		partition = *req.Partition
+	}
+	commitLog, err := topic.Partition(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	off, err := commitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: off}, nil
+	return &api.ProduceResponse{Offset: off, Partition: partition}, nil
+}
+
+// ProduceBatch appends many records to the log at once, which saves the
+// per-record overhead for producers sending lots of small records. The records
+// going to the same partition are appended as a single batch. When only some of
+// the records fail to be appended, the errors of their partitions are returned
+// in the response rather than failing the RPC, as the other records were
+// appended.
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (
+	*api.ProduceBatchResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+
+	topic, err := s.topic(req.Topic, s.AutoCreateTopics)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the records by partition, keeping track of where they were in the
+	// request and the order the partitions first show up in
+	res := &api.ProduceBatchResponse{
+		Offsets:    make([]uint64, len(req.Records)),
+		Partitions: make([]uint32, len(req.Records)),
+	}
+	var order []uint32
+	batches := make(map[uint32][]int)
+	for i, record := range req.Records {
+		partition := topic.PartitionFor(record)
+		if req.Partition != nil {
+			partition = *req.Partition
+		}
+		if _, ok := batches[partition]; !ok {
+			order = append(order, partition)
+		}
+		batches[partition] = append(batches[partition], i)
+		res.Partitions[i] = partition
+	}
+
+	// Unknown partitions fail the whole batch before anything is appended
+	commitLogs := make(map[uint32]CommitLog, len(order))
+	for _, partition := range order {
+		if commitLogs[partition], err = topic.Partition(partition); err != nil {
+			return nil, err
+		}
+	}
+
+	// The partitions are appended to independently, so a partition failing
+	// doesn't keep the others from being appended to. The failures are
+	// reported by partition, along with how many of its records were appended
+	// before, for the client to only retry the others.
+	var firstErr error
+	appended := false
+	for _, partition := range order {
+		records := make([]*api.Record, len(batches[partition]))
+		for j, i := range batches[partition] {
+			records[j] = req.Records[i]
+		}
+		offs, err := commitLogs[partition].AppendBatch(records)
+		for j, off := range offs {
+			res.Offsets[batches[partition][j]] = off
+		}
+		if len(offs) > 0 {
+			appended = true
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			st := status.Convert(err)
+			res.Errors = append(res.Errors, &api.PartitionError{
+				Partition: partition,
+				Code:      uint32(st.Code()),
+				Message:   st.Message(),
+				Appended:  uint32(len(offs)),
+			})
+		}
+	}
+	if firstErr != nil && !appended {
+		return nil, firstErr
+	}
+	return res, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
@@ -124,13 +333,143 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	read := commitLog.Read
+	if req.IsolationLevel == api.IsolationLevel_READ_COMMITTED {
+		read = commitLog.ReadCommitted
+	}
+	record, err := read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// Fetch returns the records from the requested offset, up to max bytes of them.
+// It waits for records to be appended until there are at least min bytes of
+// them, or until max wait has elapsed, whichever comes first.
+func (s *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (
+	*api.FetchResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	read, watch := commitLog.Read, commitLog.Watch
+	if req.IsolationLevel == api.IsolationLevel_READ_COMMITTED {
+		read, watch = commitLog.ReadCommitted, commitLog.WatchCommitted
+	}
+	maxBytes := int(req.MaxBytes)
+	if maxBytes == 0 {
+		maxBytes = defaultFetchMaxBytes
+	}
+	timer := time.NewTimer(time.Duration(req.MaxWaitMs) * time.Millisecond)
+	defer timer.Stop()
+
+	res := &api.FetchResponse{}
+	off, size := req.Offset, 0
+	for {
+		record, err := read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// The requested offset may have been removed from the log, in
+			// which case there is no point in waiting for it
+			lowest, err := commitLog.LowestOffset()
+			if err != nil {
+				return nil, err
+			}
+			if off < lowest {
+				return nil, api.ErrOffsetOutOfRange{Offset: off}
+			}
+			if size >= int(req.MinBytes) {
+				return fetched(commitLog, res)
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, status.FromContextError(ctx.Err()).Err()
+			case <-timer.C:
+				return fetched(commitLog, res)
+			case <-watch(off):
+			}
+			continue
+		case api.ErrOffsetCompacted, api.ErrRecordNotVisible:
+			off++
+			continue
+		default:
+			return nil, err
+		}
+
+		n := proto.Size(record)
+		if len(res.Records) > 0 && size+n > maxBytes {
+			return fetched(commitLog, res)
+		}
+		res.Records = append(res.Records, record)
+		size += n
+		off++
+	}
+}
+
+// fetched completes the response of Fetch with the high watermark of the
+// commit log, i.e. its next offset.
+func fetched(commitLog CommitLog, res *api.FetchResponse) (*api.FetchResponse, error) {
+	next, err := commitLog.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	res.HighWatermark = next
+	return res, nil
+}
+
+// GetOffsets returns the range of offsets the log currently holds, so that
+// clients can start consuming from either end of the log. The next offset tells
+// an empty log apart from a log holding a single record.
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (
+	*api.GetOffsetsResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	lowest, err := commitLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := commitLog.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := commitLog.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{
+		LowestOffset:  lowest,
+		HighestOffset: highest,
+		NextOffset:    next,
+	}, nil
+}
+
 // ProduceStream implements bidirectional streaming so the client can stream
 // request data into the server and the server can tell the client whether each
 // request succeeds or not.
@@ -152,35 +491,489 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 // ConsumeStream implements server-side streaming RPC whereas the client tells
-// the server where in the commit log to start reading records, and the server
-// will continuously stream every record that follows. When it reaches the end
-// of the log, the server will wait for new records to come in.
+// the server where in the commit log to start reading records, either by offset
+// or by timestamp, and the server will continuously stream every record that
+// follows. When it reaches the end of the log, the server will wait for new
+// records to come in.
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	ctx := stream.Context()
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	if req.StartTimestamp != 0 {
+		off, err := commitLog.OffsetForTimestamp(time.UnixMilli(req.StartTimestamp))
+		if err != nil {
+			return err
+		}
+		req.Offset = off
+	}
+
+	watch := commitLog.Watch
+	if req.IsolationLevel == api.IsolationLevel_READ_COMMITTED {
+		watch = commitLog.WatchCommitted
+	}
+
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
+		res, err := s.Consume(ctx, req)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// The requested offset may have been removed from the log, in
+			// which case there is no point in waiting for it
+			lowest, err := commitLog.LowestOffset()
+			if err != nil {
 				return err
 			}
+			if req.Offset < lowest {
+				return api.ErrOffsetOutOfRange{Offset: req.Offset}
+			}
 
-			if err = stream.Send(res); err != nil {
-				return err
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-watch(req.Offset):
 			}
+			continue
+		case api.ErrOffsetCompacted, api.ErrRecordNotVisible:
+			// The record has been superseded by a more recent one with the
+			// same key, which the stream gets to later on, or isn't meant
+			// for read-committed consumers
 			req.Offset++
+			continue
+		default:
+			return err
+		}
+
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		req.Offset++
+	}
+}
+
+// InitProducer registers an idempotent producer by giving it a new producer
+// ID. IDs are picked at random from a space large enough for collisions not to
+// be a concern, so that they don't need to be coordinated across servers.
+func (s *grpcServer) InitProducer(ctx context.Context, req *api.InitProducerRequest) (
+	*api.InitProducerResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		// Zero means the producer isn't idempotent
+		if id := binary.BigEndian.Uint64(b); id != 0 {
+			return &api.InitProducerResponse{ProducerId: id}, nil
+		}
+	}
+}
+
+// BeginTransaction opens a transaction on a partition. The records produced to
+// the partition as part of the transaction are only seen by read-committed
+// consumers once it is committed with EndTransaction.
+func (s *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (
+	*api.BeginTransactionResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	id, err := commitLog.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+// EndTransaction commits or aborts a transaction.
+func (s *grpcServer) EndTransaction(ctx context.Context, req *api.EndTransactionRequest) (
+	*api.EndTransactionResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+
+	commitLog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if req.Commit {
+		err = commitLog.CommitTransaction(req.TransactionId)
+	} else {
+		err = commitLog.AbortTransaction(req.TransactionId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{}, nil
+}
+
+// CreateTopic creates a topic ahead of producing to it, which is required
+// unless topics are created on demand.
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (
+	*api.CreateTopicResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported")
+	}
+	if _, err := s.Topics.CreateTopic(req.Topic, req.Partitions); err != nil {
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+// ListTopics returns the names of all topics.
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (
+	*api.ListTopicsResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	res := &api.ListTopicsResponse{}
+	if s.Topics == nil {
+		return res, nil
+	}
+	for _, name := range s.Topics.Topics() {
+		topic, err := s.Topics.Topic(name)
+		if err != nil {
+			return nil, err
+		}
+		res.Topics = append(res.Topics, &api.Topic{
+			Name:       name,
+			Partitions: topic.Partitions(),
+		})
+	}
+	return res, nil
+}
+
+// CommitOffset stores the offset of the next record the consumer group will
+// consume from the partition, for its consumers to resume from there later on.
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (
+	*api.CommitOffsetResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups are not supported")
+	}
+	if _, err := s.commitLog(req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	if s.Groups != nil {
+		if err := s.Groups.CheckGeneration(
+			req.Group,
+			req.MemberId,
+			req.GenerationId,
+		); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Offsets.Commit(req.Group, req.Topic, req.Partition, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// FetchOffset returns the offset the consumer group last committed for the
+// partition.
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (
+	*api.FetchOffsetResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups are not supported")
+	}
+	off, err := s.Offsets.Fetch(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: off}, nil
+}
+
+// JoinGroup adds the consumer to the group, or has a member join it again, and
+// returns the partitions assigned to it in the current generation of the group.
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (
+	*api.JoinGroupResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Groups == nil {
+		return nil, status.Error(codes.Unimplemented, "group coordination is not supported")
+	}
+	topics := make(map[string]uint32, len(req.Topics))
+	for _, name := range req.Topics {
+		topic, err := s.topic(name, false)
+		if err != nil {
+			return nil, err
+		}
+		topics[name] = topic.Partitions()
+	}
+
+	member, err := s.Groups.Join(req.Group, req.MemberId, topics, req.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.JoinGroupResponse{
+		MemberId:     member.ID,
+		GenerationId: member.Generation,
+	}
+	for name, partitions := range member.Assignment {
+		res.Assignments = append(res.Assignments, &api.Assignment{
+			Topic:      name,
+			Partitions: partitions,
+		})
+	}
+	sort.Slice(res.Assignments, func(i, j int) bool {
+		return res.Assignments[i].Topic < res.Assignments[j].Topic
+	})
+	return res, nil
+}
+
+// Heartbeat keeps the member in its group. It fails with ErrStaleGeneration
+// once the group has been rebalanced, and the member has to join it again.
+func (s *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (
+	*api.HeartbeatResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Groups == nil {
+		return nil, status.Error(codes.Unimplemented, "group coordination is not supported")
+	}
+	if err := s.Groups.Heartbeat(req.Group, req.MemberId, req.GenerationId); err != nil {
+		return nil, err
+	}
+	return &api.HeartbeatResponse{}, nil
+}
+
+// LeaveGroup removes the member from its group, rather than waiting for its
+// session to time out, so that its partitions are reassigned right away.
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (
+	*api.LeaveGroupResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Groups == nil {
+		return nil, status.Error(codes.Unimplemented, "group coordination is not supported")
+	}
+	if err := s.Groups.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// Lease delivers the next record of the work queue, waiting up to max wait for
+// one to be available.
+func (s *grpcServer) Lease(ctx context.Context, req *api.LeaseRequest) (
+	*api.LeaseResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Queue == nil {
+		return nil, status.Error(codes.Unimplemented, "work queue is not supported")
+	}
+	ctx, cancel := context.WithTimeout(
+		ctx,
+		time.Duration(req.MaxWaitMs)*time.Millisecond,
+	)
+	defer cancel()
+
+	for {
+		d, err := s.Queue.Lease()
+		switch err.(type) {
+		case nil:
+			return &api.LeaseResponse{
+				Record:     d.Record,
+				Deliveries: d.Deliveries,
+				Deadline:   d.Deadline.UnixMilli(),
+			}, nil
+		case api.ErrOffsetOutOfRange:
+		default:
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &api.LeaseResponse{}, nil
+		case <-s.Queue.Watch(ctx.Done()):
 		}
 	}
 }
 
+// Ack acknowledges that a record leased from the work queue has been
+// processed, so that it isn't delivered again.
+func (s *grpcServer) Ack(ctx context.Context, req *api.AckRequest) (
+	*api.AckResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Queue == nil {
+		return nil, status.Error(codes.Unimplemented, "work queue is not supported")
+	}
+	if err := s.Queue.Ack(req.Offset, req.Deliveries); err != nil {
+		return nil, err
+	}
+	return &api.AckResponse{}, nil
+}
+
+// Nack gives a record leased from the work queue back, so that it is delivered
+// again right away.
+func (s *grpcServer) Nack(ctx context.Context, req *api.NackRequest) (
+	*api.NackResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.Queue == nil {
+		return nil, status.Error(codes.Unimplemented, "work queue is not supported")
+	}
+	if err := s.Queue.Nack(req.Offset, req.Deliveries); err != nil {
+		return nil, err
+	}
+	return &api.NackResponse{}, nil
+}
+
+// GetServers returns the servers of the cluster, with their RPC address and
+// whether they are the leader, so that clients can discover them.
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (
+	*api.GetServersResponse, error,
+) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	if s.ServerGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "server discovery is not supported")
+	}
+	servers, err := s.ServerGetter.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// topic returns the given topic, creating it with a single partition if it
+// doesn't exist and create is set. The requests without a topic are served by
+// the default commit log.
+func (s *grpcServer) topic(name string, create bool) (Topic, error) {
+	switch {
+	case name == "" && s.CommitLog != nil:
+		return defaultTopic{s.CommitLog}, nil
+	case name == "" || s.Topics == nil:
+		return nil, api.ErrTopicNotFound{Topic: name}
+	case create:
+		return s.Topics.CreateTopic(name, 1)
+	default:
+		return s.Topics.Topic(name)
+	}
+}
+
+// commitLog returns the commit log of the given partition of the given topic.
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	t, err := s.topic(topic, false)
+	if err != nil {
+		return nil, err
+	}
+	return t.Partition(partition)
+}
+
 // authenticate is an interceptor that reads the subject out of client's cert and
 // write it to the gRPC context.
 func authenticate(ctx context.Context) (context.Context, error) {
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net"
 	"os"
 	"testing"
@@ -12,6 +13,7 @@ import (
 	api "github.com/tkhoa2711/proglog/api/v1"
 	"github.com/tkhoa2711/proglog/internal/auth"
 	"github.com/tkhoa2711/proglog/internal/config"
+	"github.com/tkhoa2711/proglog/internal/group"
 	"github.com/tkhoa2711/proglog/internal/log"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
@@ -46,7 +48,23 @@ func TestServer(t *testing.T) {
 	){
 		"produce/consume a message to/from the log": testProduceConsume,
 		"produce/consume stream to/from the log":    testProduceConsumeStream,
+		"produce a batch of messages to the log":    testProduceBatch,
+		"produce a batch with a failing partition":  testProduceBatchPartialFailure,
+		"consume stream waits for new records":      testConsumeStreamWaitsForNewRecords,
+		"consume stream from a point in time":       testConsumeStreamFromTimestamp,
 		"consume past log boundary":                 testConsumePastLogBoundary,
+		"get offsets of the log":                    testGetOffsets,
+		"long-poll fetch":                           testFetch,
+		"produce/consume to/from topics":            testProduceConsumeTopics,
+		"produce to unknown topic":                  testProduceUnknownTopic,
+		"unauthorized access to create topic":       testUnauthorizedClientCantCreateTopic,
+		"produce/consume to/from partitions":        testProduceConsumePartitions,
+		"idempotent producer retries":               testIdempotentProducer,
+		"read-committed consume of transactions":    testConsumeTransactions,
+		"commit/fetch consumer group offsets":       testCommitFetchOffset,
+		"consumer group rebalancing":                testConsumerGroupRebalance,
+		"work queue lease/ack/nack":                 testWorkQueue,
+		"get servers of the cluster":                testGetServers,
 		"unauthorized access to produce":            testUnauthorizedClientCantProduce,
 		"unauthorized access to consume":            testUnauthorizedClientCantConsume,
 	} {
@@ -151,10 +169,31 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	commitLog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
+	topicsDir, err := os.MkdirTemp("", "server-topics-test")
+	require.NoError(t, err)
+	topics, err := log.NewLogManager(topicsDir, log.Config{})
+	require.NoError(t, err)
+
+	offsetsDir, err := os.MkdirTemp("", "server-offsets-test")
+	require.NoError(t, err)
+	offsets, err := log.NewOffsetStore(offsetsDir, log.Config{})
+	require.NoError(t, err)
+
+	groups := group.NewCoordinator(group.Config{})
+
+	queueDir, err := os.MkdirTemp("", "server-queue-test")
+	require.NoError(t, err)
+	queue, err := log.NewQueue(commitLog, queueDir, log.Config{})
+	require.NoError(t, err)
+
 	// Create the test gRPC server
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 	cfg = &Config{
 		CommitLog:  commitLog,
+		Topics:     NewTopicManager(topics),
+		Offsets:    offsets,
+		Groups:     groups,
+		Queue:      queue,
 		Authorizer: authorizer,
 	}
 
@@ -175,6 +214,10 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		unauthorizedConn.Close()
 		l.Close()
 		commitLog.Close()
+		topics.Close()
+		offsets.Close()
+		groups.Close()
+		queue.Close()
 
 		if telemetryExporter != nil {
 			time.Sleep(1000 * time.Millisecond)
@@ -245,12 +288,189 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.Timestamp)
+		}
+	}
+}
+
+func testProduceBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+
+	produce, err := client.ProduceBatch(
+		ctx,
+		&api.ProduceBatchRequest{Records: records},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, produce.Offsets)
+
+	for i, record := range records {
+		consume, err := client.Consume(
+			ctx,
+			&api.ConsumeRequest{Offset: produce.Offsets[i]},
+		)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+}
+
+func testProduceBatchPartialFailure(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      "orders",
+		Partitions: 2,
+	})
+	require.NoError(t, err)
+	one := uint32(1)
+	begin, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{
+		Topic:     "orders",
+		Partition: one,
+	})
+	require.NoError(t, err)
+
+	// Records without a key go to the partitions in turn, the transaction is
+	// only open on the second one
+	records := []*api.Record{
+		{Value: []byte("first"), TransactionId: begin.TransactionId},
+		{Value: []byte("second"), TransactionId: begin.TransactionId},
+	}
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic:   "orders",
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1}, batch.Partitions)
+	require.Len(t, batch.Errors, 1)
+	require.Equal(t, uint32(0), batch.Errors[0].Partition)
+	require.Equal(t, uint32(0), batch.Errors[0].Appended)
+	want := status.Code(api.ErrTransactionNotFound{}.GRPCStatus().Err())
+	require.Equal(t, uint32(want), batch.Errors[0].Code)
+
+	// The records of the other partition have been appended
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Topic:     "orders",
+		Partition: one,
+		Offset:    batch.Offsets[1],
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	outOfRange := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, outOfRange, status.Code(err))
+
+	// A partition failing in the middle of its records keeps the offsets of
+	// the records appended before, which aren't to be retried
+	second := batch.Offsets[1]
+	batch, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic:     "orders",
+		Partition: &one,
+		Records: []*api.Record{
+			{Value: []byte("third"), TransactionId: begin.TransactionId},
+			{Value: []byte("unknown"), TransactionId: begin.TransactionId + 1},
+			{Value: []byte("fourth"), TransactionId: begin.TransactionId},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, batch.Errors, 1)
+	require.Equal(t, one, batch.Errors[0].Partition)
+	require.Equal(t, uint32(1), batch.Errors[0].Appended)
+	require.Equal(t, second+1, batch.Offsets[0])
+	require.Zero(t, batch.Offsets[1])
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Topic:     "orders",
+		Partition: one,
+		Offset:    batch.Offsets[0],
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), consume.Record.Value)
+
+	// A batch appended to no partition at all fails as a whole
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic:     "orders",
+		Partition: new(uint32),
+		Records:   records[:1],
+	})
+	require.Equal(t, want, status.Code(err))
+}
+
+func testConsumeStreamWaitsForNewRecords(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	received := make(chan *api.ConsumeResponse)
+	go func() {
+		res, err := stream.Recv()
+		if err == nil {
+			received <- res
 		}
+	}()
+
+	select {
+	case <-received:
+		t.Fatal("received a record from an empty log")
+	case <-time.After(50 * time.Millisecond):
 	}
+
+	want := &api.Record{Value: []byte("Hello World!")}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+
+	select {
+	case res := <-received:
+		require.Equal(t, want.Value, res.Record.Value)
+		require.Equal(t, uint64(0), res.Record.Offset)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the produced record")
+	}
+}
+
+func testConsumeStreamFromTimestamp(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	for i, ts := range []time.Time{
+		start.Add(-time.Hour),
+		start.Add(-time.Minute),
+		start,
+	} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value:     []byte(fmt.Sprintf("message %d", i)),
+				Timestamp: ts.UnixMilli(),
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		StartTimestamp: start.Add(-30 * time.Minute).UnixMilli(),
+	})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Record.Offset)
+	require.Equal(t, []byte("message 1"), res.Record.Value)
 }
 
 func testConsumePastLogBoundary(
@@ -280,6 +500,43 @@ func testConsumePastLogBoundary(
 	require.Equal(t, want, got)
 }
 
+func testGetOffsets(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// An empty log and a log holding only offset 0 have the same highest
+	// offset, but not the same next offset
+	res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowestOffset)
+	require.Equal(t, uint64(0), res.HighestOffset)
+	require.Equal(t, uint64(0), res.NextOffset)
+
+	_, err = client.Produce(
+		ctx,
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("Hello World!")}},
+	)
+	require.NoError(t, err)
+	res, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowestOffset)
+	require.Equal(t, uint64(0), res.HighestOffset)
+	require.Equal(t, uint64(1), res.NextOffset)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Produce(
+			ctx,
+			&api.ProduceRequest{Record: &api.Record{Value: []byte("Hello World!")}},
+		)
+		require.NoError(t, err)
+	}
+
+	res, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowestOffset)
+	require.Equal(t, uint64(2), res.HighestOffset)
+	require.Equal(t, uint64(3), res.NextOffset)
+}
+
 func testUnauthorizedClientCantProduce(
 	t *testing.T,
 	_, unauthorizedClient api.LogClient,
@@ -317,3 +574,568 @@ func testUnauthorizedClientCantConsume(
 	require.Error(t, err)
 	require.Equal(t, status.Code(err), codes.PermissionDenied)
 }
+
+func testFetch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	res, err := client.Fetch(ctx, &api.FetchRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+	require.Equal(t, uint64(0), res.HighWatermark)
+
+	for i := 0; i < 3; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err = client.Fetch(ctx, &api.FetchRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, []byte("record 1"), res.Records[0].Value)
+	require.Equal(t, []byte("record 2"), res.Records[1].Value)
+	require.Equal(t, uint64(3), res.HighWatermark)
+
+	// The first record is returned even if it is larger than max bytes
+	res, err = client.Fetch(ctx, &api.FetchRequest{MaxBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+
+	// Nothing gets appended within max wait
+	res, err = client.Fetch(ctx, &api.FetchRequest{
+		Offset:    3,
+		MinBytes:  1,
+		MaxWaitMs: 50,
+	})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+
+	// The fetch waits for the record to be appended
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("record 3")},
+		})
+		require.NoError(t, err)
+	}()
+	res, err = client.Fetch(ctx, &api.FetchRequest{
+		Offset:    3,
+		MinBytes:  1,
+		MaxWaitMs: 5000,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, []byte("record 3"), res.Records[0].Value)
+	require.Equal(t, uint64(4), res.HighWatermark)
+}
+
+func testProduceConsumeTopics(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      "payments",
+		Partitions: 2,
+	})
+	require.NoError(t, err)
+
+	topics, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, topics.Topics, 2)
+	require.Equal(t, "orders", topics.Topics[0].Name)
+	require.Equal(t, uint32(1), topics.Topics[0].Partitions)
+	require.Equal(t, "payments", topics.Topics[1].Name)
+	require.Equal(t, uint32(2), topics.Topics[1].Partitions)
+
+	// Each topic and the default log have their own offsets
+	var partition uint32
+	for _, topic := range []string{"", "orders", "payments"} {
+		for i := uint64(0); i < 2; i++ {
+			produce, err := client.Produce(ctx, &api.ProduceRequest{
+				Topic:     topic,
+				Partition: &partition,
+				Record:    &api.Record{Value: []byte(fmt.Sprintf("%s %d", topic, i))},
+			})
+			require.NoError(t, err)
+			require.Equal(t, i, produce.Offset)
+		}
+	}
+
+	for _, topic := range []string{"", "orders", "payments"} {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Topic:  topic,
+			Offset: 1,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("%s 1", topic)), consume.Record.Value)
+
+		offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: topic})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), offsets.HighestOffset)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders 0"), res.Record.Value)
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "../orders"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testProduceUnknownTopic(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "unknown",
+		Record: &api.Record{Value: []byte("Hello World!")},
+	})
+	want := status.Code(api.ErrTopicNotFound{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "unknown"})
+	require.Equal(t, want, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "unknown"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, want, status.Code(err))
+}
+
+func testCommitFetchOffset(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      "orders",
+		Partitions: 2,
+	})
+	require.NoError(t, err)
+
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group: "billing",
+		Topic: "orders",
+	})
+	want := status.Code(api.ErrNoCommittedOffset{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+
+	for _, off := range []uint64{3, 7} {
+		_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+			Group:     "billing",
+			Topic:     "orders",
+			Partition: 1,
+			Offset:    off,
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group:     "billing",
+		Topic:     "orders",
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Offset)
+
+	// Each group has its own offsets
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{
+		Group:     "shipping",
+		Topic:     "orders",
+		Partition: 1,
+	})
+	require.Equal(t, want, status.Code(err))
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "billing",
+		Topic: "unknown",
+	})
+	want = status.Code(api.ErrTopicNotFound{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+}
+
+func testConsumerGroupRebalance(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      "orders",
+		Partitions: 3,
+	})
+	require.NoError(t, err)
+
+	join := func(memberID string) *api.JoinGroupResponse {
+		res, err := client.JoinGroup(ctx, &api.JoinGroupRequest{
+			Group:    "billing",
+			MemberId: memberID,
+			Topics:   []string{"orders"},
+			Strategy: api.AssignmentStrategy_ROUND_ROBIN,
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	a := join("")
+	require.Len(t, a.Assignments, 1)
+	require.Equal(t, "orders", a.Assignments[0].Topic)
+	require.Equal(t, []uint32{0, 1, 2}, a.Assignments[0].Partitions)
+
+	b := join("")
+	_, err = client.Heartbeat(ctx, &api.HeartbeatRequest{
+		Group:        "billing",
+		MemberId:     a.MemberId,
+		GenerationId: a.GenerationId,
+	})
+	want := status.Code(api.ErrStaleGeneration{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+
+	// The first member is fenced off until it joins again
+	commit := &api.CommitOffsetRequest{
+		Group:        "billing",
+		Topic:        "orders",
+		Offset:       1,
+		MemberId:     a.MemberId,
+		GenerationId: a.GenerationId,
+	}
+	_, err = client.CommitOffset(ctx, commit)
+	require.Equal(t, want, status.Code(err))
+
+	a = join(a.MemberId)
+	require.Equal(t, b.GenerationId, a.GenerationId)
+	commit.Partition = a.Assignments[0].Partitions[0]
+	commit.GenerationId = a.GenerationId
+	_, err = client.CommitOffset(ctx, commit)
+	require.NoError(t, err)
+
+	var partitions []uint32
+	for _, res := range []*api.JoinGroupResponse{a, b} {
+		partitions = append(partitions, res.Assignments[0].Partitions...)
+	}
+	require.ElementsMatch(t, []uint32{0, 1, 2}, partitions)
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: b.MemberId,
+	})
+	require.NoError(t, err)
+	a = join(a.MemberId)
+	require.Equal(t, []uint32{0, 1, 2}, a.Assignments[0].Partitions)
+}
+
+func testWorkQueue(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	res, err := client.Lease(ctx, &api.LeaseRequest{})
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+
+	// The lease waits for a record to be produced
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("job")},
+		})
+		require.NoError(t, err)
+	}()
+	res, err = client.Lease(ctx, &api.LeaseRequest{MaxWaitMs: 5000})
+	require.NoError(t, err)
+	require.Equal(t, []byte("job"), res.Record.Value)
+	require.Equal(t, uint32(1), res.Deliveries)
+
+	// Nacked records are delivered again, acked ones aren't
+	_, err = client.Nack(ctx, &api.NackRequest{
+		Offset:     res.Record.Offset,
+		Deliveries: res.Deliveries,
+	})
+	require.NoError(t, err)
+	res, err = client.Lease(ctx, &api.LeaseRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), res.Deliveries)
+
+	// Only the latest lease of the record can be acked
+	_, err = client.Ack(ctx, &api.AckRequest{
+		Offset:     res.Record.Offset,
+		Deliveries: 1,
+	})
+	want := status.Code(api.ErrStaleLease{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+	_, err = client.Ack(ctx, &api.AckRequest{
+		Offset:     res.Record.Offset,
+		Deliveries: res.Deliveries,
+	})
+	require.NoError(t, err)
+	res, err = client.Lease(ctx, &api.LeaseRequest{})
+	require.NoError(t, err)
+	require.Nil(t, res.Record)
+
+	_, err = client.Ack(ctx, &api.AckRequest{Offset: 0, Deliveries: 2})
+	want = status.Code(api.ErrLeaseNotFound{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+}
+
+func testUnauthorizedClientCantCreateTopic(
+	t *testing.T,
+	_, unauthorizedClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	_, err := unauthorizedClient.CreateTopic(
+		ctx,
+		&api.CreateTopicRequest{Topic: "orders"},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testGetServers(
+	t *testing.T,
+	client, _ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+
+	_, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	config.ServerGetter = serverGetter{
+		{Id: "0", RpcAddr: "localhost:9001", IsLeader: true},
+		{Id: "1", RpcAddr: "localhost:9002"},
+	}
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Servers))
+	for i, want := range config.ServerGetter.(serverGetter) {
+		require.Equal(t, want.Id, res.Servers[i].Id)
+		require.Equal(t, want.RpcAddr, res.Servers[i].RpcAddr)
+		require.Equal(t, want.IsLeader, res.Servers[i].IsLeader)
+	}
+}
+
+// serverGetter returns the given servers.
+type serverGetter []*api.Server
+
+func (g serverGetter) GetServers() ([]*api.Server, error) {
+	return g, nil
+}
+
+func TestServerAutoCreateTopics(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(c *Config) {
+		c.AutoCreateTopics = true
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// Consuming doesn't create the topic
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "orders",
+		Record: &api.Record{Value: []byte("Hello World!")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+	require.Equal(t, []string{"orders"}, config.Topics.Topics())
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("Hello World!"), consume.Record.Value)
+}
+
+func testProduceConsumePartitions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      "orders",
+		Partitions: 3,
+	})
+	require.NoError(t, err)
+
+	// Records with the same key go to the same partition, in order
+	var partition uint32
+	for i := uint64(0); i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic: "orders",
+			Record: &api.Record{
+				Key:   []byte("customer-1"),
+				Value: []byte(fmt.Sprintf("order %d", i)),
+			},
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, produce.Offset)
+		if i > 0 {
+			require.Equal(t, partition, produce.Partition)
+		}
+		partition = produce.Partition
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:     "orders",
+		Partition: partition,
+	})
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, res.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("order %d", i)), res.Record.Value)
+	}
+
+	// Producers may pick the partition themselves, batches are split by
+	// partition
+	other := (partition + 1) % 3
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic: "orders",
+		Records: []*api.Record{
+			{Key: []byte("customer-1"), Value: []byte("order 3")},
+			{Key: []byte("customer-1"), Value: []byte("order 4")},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, batch.Offsets)
+	require.Equal(t, []uint32{partition, partition}, batch.Partitions)
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "orders",
+		Partition: &other,
+		Record:    &api.Record{Key: []byte("customer-1"), Value: []byte("elsewhere")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, other, produce.Partition)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{
+		Topic:     "orders",
+		Partition: partition,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), offsets.HighestOffset)
+
+	missing := uint32(3)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "orders",
+		Partition: &missing,
+		Record:    &api.Record{Value: []byte("nowhere")},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testIdempotentProducer(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	init, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, init.ProducerId)
+
+	other, err := client.InitProducer(ctx, &api.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotEqual(t, init.ProducerId, other.ProducerId)
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+
+	// The second record is retried, e.g. after the stream broke before the
+	// producer got its response
+	for i, seq := range []uint64{0, 1, 1, 2} {
+		err = stream.Send(&api.ProduceRequest{
+			Record: &api.Record{
+				Value:      []byte(fmt.Sprintf("message %d", seq)),
+				ProducerId: init.ProducerId,
+				Sequence:   seq,
+			},
+		})
+		require.NoError(t, err)
+
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, seq, res.Offset, "record %d", i)
+	}
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{
+			Value:      []byte("message 5"),
+			ProducerId: init.ProducerId,
+			Sequence:   5,
+		},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	offsets, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offsets.HighestOffset)
+}
+
+func testConsumeTransactions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	produce := func(txn uint64, value string) {
+		t.Helper()
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value), TransactionId: txn},
+		})
+		require.NoError(t, err)
+	}
+
+	aborted, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce(aborted.TransactionId, "aborted")
+	_, err = client.EndTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: aborted.TransactionId,
+	})
+	require.NoError(t, err)
+
+	committed, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.NoError(t, err)
+	produce(committed.TransactionId, "committed 1")
+	produce(0, "outside")
+	produce(committed.TransactionId, "committed 2")
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		IsolationLevel: api.IsolationLevel_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	received := make(chan *api.Record)
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			received <- res.Record
+		}
+	}()
+
+	// Nothing comes through until the transaction is committed
+	select {
+	case record := <-received:
+		t.Fatalf("received record %d of an open transaction", record.Offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = client.EndTransaction(ctx, &api.EndTransactionRequest{
+		TransactionId: committed.TransactionId,
+		Commit:        true,
+	})
+	require.NoError(t, err)
+
+	for _, want := range []string{"committed 1", "outside", "committed 2"} {
+		select {
+		case record := <-received:
+			require.Equal(t, []byte(want), record.Value)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	// Read-uncommitted consumers see everything
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("aborted"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:         1,
+		IsolationLevel: api.IsolationLevel_READ_COMMITTED,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
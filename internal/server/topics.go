@@ -0,0 +1,68 @@
+package server
+
+import (
+	api "github.com/tkhoa2711/proglog/api/v1"
+	"github.com/tkhoa2711/proglog/internal/log"
+)
+
+// logManager adapts a log.LogManager, whose methods return the concrete topic
+// and log types, to the TopicManager interface.
+type logManager struct {
+	*log.LogManager
+}
+
+// NewTopicManager returns a TopicManager serving the topics of the given log
+// manager.
+func NewTopicManager(m *log.LogManager) TopicManager {
+	return logManager{m}
+}
+
+func (m logManager) Topic(name string) (Topic, error) {
+	t, err := m.LogManager.Topic(name)
+	if err != nil {
+		return nil, err
+	}
+	return logTopic{t}, nil
+}
+
+func (m logManager) CreateTopic(name string, partitions uint32) (Topic, error) {
+	t, err := m.LogManager.CreateTopic(name, partitions)
+	if err != nil {
+		return nil, err
+	}
+	return logTopic{t}, nil
+}
+
+// logTopic adapts a log.Topic to the Topic interface.
+type logTopic struct {
+	*log.Topic
+}
+
+func (t logTopic) Partition(n uint32) (CommitLog, error) {
+	l, err := t.Topic.Partition(n)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// defaultTopic serves the requests without a topic from the default commit log,
+// as a topic with a single partition.
+type defaultTopic struct {
+	CommitLog
+}
+
+func (t defaultTopic) Partitions() uint32 {
+	return 1
+}
+
+func (t defaultTopic) Partition(n uint32) (CommitLog, error) {
+	if n != 0 {
+		return nil, api.ErrPartitionNotFound{Partition: n}
+	}
+	return t.CommitLog, nil
+}
+
+func (t defaultTopic) PartitionFor(*api.Record) uint32 {
+	return 0
+}